@@ -0,0 +1,161 @@
+package client
+
+import (
+	"github.com/myzhan/goreplay-udp/stats"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minResolveBackoff = 100 * time.Millisecond
+	maxResolveBackoff = 10 * time.Second
+)
+
+// resolver keeps addresses of target host up to date, shared by all clients of the host
+type resolver struct {
+	host     string
+	interval time.Duration
+
+	mu    sync.RWMutex
+	ips   []net.IP
+	zone  string
+	ready chan struct{}
+	// Incremented on each change of addresses, so clients know to redial
+	version int
+
+	changes  *stats.Counter
+	failures *stats.Counter
+}
+
+var (
+	resolversMu sync.Mutex
+	resolvers   = make(map[string]*resolver)
+)
+
+// getResolver returns shared resolver of the host, IP literals are never re-resolved.
+// Empty host is the local system, like in net.Dial.
+func getResolver(host string, interval time.Duration) *resolver {
+	resolversMu.Lock()
+	defer resolversMu.Unlock()
+
+	key := host + "/" + interval.String()
+	if r, ok := resolvers[key]; ok {
+		return r
+	}
+
+	r := &resolver{host: host, interval: interval, ready: make(chan struct{})}
+	resolvers[key] = r
+
+	ipHost, zone := host, ""
+	if i := strings.LastIndexByte(host, '%'); i != -1 {
+		ipHost, zone = host[:i], host[i+1:]
+	}
+
+	if ipHost == "" {
+		ipHost = net.IPv4(127, 0, 0, 1).String()
+	}
+
+	if ip := net.ParseIP(ipHost); ip != nil {
+		r.ips, r.zone = []net.IP{ip}, zone
+		close(r.ready)
+		return r
+	}
+
+	r.changes = stats.NewCounter("output_udp_dns "+host, "changes")
+	r.failures = stats.NewCounter("output_udp_dns "+host, "failures")
+
+	go r.run()
+
+	return r
+}
+
+// addresses returns current addresses and their version, waiting for the first resolution up to timeout
+func (r *resolver) addresses(timeout time.Duration) ([]net.IP, string, int) {
+	select {
+	case <-r.ready:
+	default:
+		timer := time.NewTimer(timeout)
+		select {
+		case <-r.ready:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.ips, r.zone, r.version
+}
+
+func (r *resolver) run() {
+	backoff := minResolveBackoff
+	first := true
+
+	for {
+		ips, err := net.LookupIP(r.host)
+		if err != nil || len(ips) == 0 {
+			r.failures.Add(1)
+
+			log.Printf("output_udp_dns:%s resolve failed, retry in %s: %v\n", r.host, backoff, err)
+			time.Sleep(backoff)
+
+			if backoff *= 2; backoff > maxResolveBackoff {
+				backoff = maxResolveBackoff
+			}
+			continue
+		}
+		backoff = minResolveBackoff
+
+		r.update(ips)
+
+		if first {
+			close(r.ready)
+			first = false
+		}
+
+		if r.interval == 0 {
+			return
+		}
+		time.Sleep(r.interval)
+	}
+}
+
+func (r *resolver) update(ips []net.IP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if sameIPs(r.ips, ips) {
+		return
+	}
+
+	if r.version > 0 {
+		r.changes.Add(1)
+	}
+	r.version++
+
+	log.Printf("output_udp_dns:%s resolved to %v\n", r.host, ips)
+	r.ips = ips
+}
+
+// sameIPs compares address sets, DNS servers may rotate records order
+func sameIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	seen := make(map[string]bool, len(a))
+	for _, ip := range a {
+		seen[string(ip.To16())] = true
+	}
+	for _, ip := range b {
+		if !seen[string(ip.To16())] {
+			return false
+		}
+	}
+
+	return true
+}
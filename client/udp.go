@@ -1,52 +1,370 @@
 package client
 
 import (
+	"errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 	"log"
 	"net"
 	"time"
 )
 
+// Requests are dropped without logging while target isn't available, see IsUnavailable
+var (
+	errNoAddress   = errors.New("target is not resolved yet")
+	errDialDelayed = errors.New("dial of target is delayed after failure")
+)
+
+// IsUnavailable checks if request is dropped because target isn't resolved or dial failed recently
+func IsUnavailable(err error) bool {
+	return err == errNoAddress || err == errDialDelayed
+}
+
+type UDPClientConfig struct {
+	Timeout        time.Duration
+	IgnoreResponse bool
+
+	// Hostname of the target is resolved again after this interval, 0 resolves it once
+	ResolveInterval time.Duration
+
+	// Multicast TTL (hop limit for IPv6), 0 keeps system default of 1
+	MulticastTTL int
+	// Deliver multicast requests to listeners on this host too
+	MulticastLoopback bool
+	// Outgoing interface name for multicast, zone of the group address is used by default
+	MulticastInterface string
+}
+
+// batchWriter is implemented by both ipv4 and ipv6 packet connections, they share Message type
+type batchWriter interface {
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// udpConn is socket to one of resolved target addresses
+type udpConn struct {
+	conn  *net.UDPConn
+	addr  *net.UDPAddr
+	batch batchWriter
+
+	// Multicast and broadcast targets are sent from unconnected socket,
+	// because members answer from their own addresses
+	group bool
+}
+
+// UDPClient spreads requests over all addresses of the target in round robin,
+// sockets are dialed again when addresses change. Failed dial is retried with backoff.
 type UDPClient struct {
-	address        string
-	timeout        time.Duration
-	ignoreResponse bool
+	address string
+	port    int
+	config  *UDPClientConfig
+
+	resolver *resolver
+	version  int
+	conns    []*udpConn
+	next     int
+
+	backoff time.Duration
+	retryAt time.Time
 
-	conn *net.UDPConn
+	// Reused by SendBatch
+	messages []ipv4.Message
 }
 
-func NewUDPClient(address string, timeout time.Duration, ignoreResponse bool) (c *UDPClient) {
+func NewUDPClient(address string, config *UDPClientConfig) (c *UDPClient) {
 	c = new(UDPClient)
 	c.address = address
-	c.timeout = timeout
-	c.ignoreResponse = ignoreResponse
+	c.config = config
 
-	addr, err := net.ResolveUDPAddr("udp", address)
+	// IPv6 targets are given in brackets, link-local ones with zone: [fe80::1%eth0]:53
+	host, port, err := net.SplitHostPort(address)
 	if err != nil {
-		log.Fatalf("Error initialize UDP Client %s\n", address)
+		log.Fatalf("Error initialize UDP Client %s, %v\n", address, err)
+	}
+	if c.port, err = net.LookupPort("udp", port); err != nil {
+		log.Fatalf("Error initialize UDP Client %s, %v\n", address, err)
+	}
+
+	c.resolver = getResolver(host, config.ResolveInterval)
+
+	return
+}
+
+// connection returns socket for the next request, dialing resolved addresses if needed
+func (c *UDPClient) connection() (*udpConn, error) {
+	ips, zone, version := c.resolver.addresses(c.config.Timeout)
+	if version != c.version {
+		c.closeConns()
+		c.version = version
+		c.backoff = 0
+	}
+
+	if len(ips) == 0 {
+		return nil, errNoAddress
 	}
 
-	conn, err := net.DialUDP("udp", nil, addr)
+	if c.conns == nil {
+		if time.Now().Before(c.retryAt) {
+			return nil, errDialDelayed
+		}
+
+		var lastErr error
+		for _, ip := range ips {
+			conn, err := dial(&net.UDPAddr{IP: ip, Port: c.port, Zone: zone}, c.config)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			c.conns = append(c.conns, conn)
+		}
+
+		// Unreachable addresses are skipped, backoff only when none is left
+		if c.conns == nil {
+			c.delayRetry()
+			return nil, lastErr
+		}
+		c.backoff = 0
+	}
+
+	conn := c.conns[c.next%len(c.conns)]
+	c.next++
+
+	return conn, nil
+}
+
+func (c *UDPClient) delayRetry() {
+	if c.backoff *= 2; c.backoff < minResolveBackoff {
+		c.backoff = minResolveBackoff
+	} else if c.backoff > maxResolveBackoff {
+		c.backoff = maxResolveBackoff
+	}
+
+	c.retryAt = time.Now().Add(c.backoff)
+}
+
+func dial(addr *net.UDPAddr, config *UDPClientConfig) (c *udpConn, err error) {
+	c = &udpConn{addr: addr}
+
+	switch {
+	case addr.IP.IsMulticast():
+		c.group = true
+		if c.conn, err = listenUnconnected(addr); err != nil {
+			return nil, err
+		}
+		if err = setupMulticast(c.conn, addr, config); err != nil {
+			c.conn.Close()
+			return nil, err
+		}
+	case isBroadcast(addr.IP):
+		// Go enables SO_BROADCAST on all UDP sockets
+		c.group = true
+		if c.conn, err = listenUnconnected(addr); err != nil {
+			return nil, err
+		}
+	default:
+		if c.conn, err = net.DialUDP("udp", nil, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	if addr.IP.To4() != nil {
+		c.batch = ipv4.NewPacketConn(c.conn)
+	} else {
+		c.batch = ipv6.NewPacketConn(c.conn)
+	}
+
+	return c, nil
+}
+
+func listenUnconnected(addr *net.UDPAddr) (*net.UDPConn, error) {
+	network := "udp6"
+	if addr.IP.To4() != nil {
+		network = "udp4"
+	}
+
+	return net.ListenUDP(network, nil)
+}
+
+func setupMulticast(conn *net.UDPConn, addr *net.UDPAddr, config *UDPClientConfig) (err error) {
+	var iface *net.Interface
+	name := config.MulticastInterface
+	if name == "" {
+		name = addr.Zone
+	}
+	if name != "" {
+		if iface, err = net.InterfaceByName(name); err != nil {
+			return err
+		}
+	}
+
+	if addr.IP.To4() != nil {
+		p := ipv4.NewPacketConn(conn)
+		if config.MulticastTTL > 0 {
+			if err = p.SetMulticastTTL(config.MulticastTTL); err != nil {
+				return err
+			}
+		}
+		if iface != nil {
+			if err = p.SetMulticastInterface(iface); err != nil {
+				return err
+			}
+		}
+		return p.SetMulticastLoopback(config.MulticastLoopback)
+	}
+
+	p := ipv6.NewPacketConn(conn)
+	if config.MulticastTTL > 0 {
+		if err = p.SetMulticastHopLimit(config.MulticastTTL); err != nil {
+			return err
+		}
+	}
+	if iface != nil {
+		if err = p.SetMulticastInterface(iface); err != nil {
+			return err
+		}
+	}
+	return p.SetMulticastLoopback(config.MulticastLoopback)
+}
+
+// isBroadcast checks for limited broadcast or directed broadcast of local IPv4 subnets
+func isBroadcast(ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+	if ip4.Equal(net.IPv4bcast) {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
 	if err != nil {
-		log.Fatalf("Error dialing %s\n", address)
+		return false
 	}
 
-	c.conn = conn
-	return
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil || len(ipnet.Mask) != net.IPv4len {
+			continue
+		}
+
+		// Point-to-point subnets have no broadcast address
+		if ones, bits := ipnet.Mask.Size(); bits-ones < 2 {
+			continue
+		}
+
+		network := ipnet.IP.To4()
+		broadcast := true
+		for i := range ip4 {
+			if ip4[i] != network[i]|^ipnet.Mask[i] {
+				broadcast = false
+				break
+			}
+		}
+		if broadcast {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *UDPClient) closeConns() {
+	for _, conn := range c.conns {
+		conn.conn.Close()
+	}
+	c.conns = nil
+}
+
+// dropConn fails over to other addresses, all of them are dialed again after backoff when none is left
+func (c *UDPClient) dropConn(failed *udpConn) {
+	failed.conn.Close()
+
+	for i, conn := range c.conns {
+		if conn == failed {
+			c.conns = append(c.conns[:i], c.conns[i+1:]...)
+			break
+		}
+	}
+
+	if len(c.conns) == 0 {
+		c.conns = nil
+		c.delayRetry()
+	}
+}
+
+func (c *UDPClient) Close() error {
+	c.closeConns()
+	return nil
+}
+
+func (c *UDPClient) dialedConnection() (*udpConn, error) {
+	conn, err := c.connection()
+	if err != nil && !IsUnavailable(err) {
+		log.Printf("UDP Dial Error %s: %v\n", c.address, err)
+	}
+
+	return conn, err
 }
 
+// SendBatch writes requests without reading responses, using as few syscalls as possible:
+// sendmmsg on Linux, one write per request on other systems. Returns number of sent requests.
+func (c *UDPClient) SendBatch(data [][]byte) (int, error) {
+	conn, err := c.dialedConnection()
+	if err != nil {
+		return 0, err
+	}
+
+	if cap(c.messages) < len(data) {
+		c.messages = make([]ipv4.Message, len(data))
+	}
+	messages := c.messages[:len(data)]
+
+	for i, d := range data {
+		messages[i].Buffers = [][]byte{d}
+		messages[i].Addr = nil
+		if conn.group {
+			messages[i].Addr = conn.addr
+		}
+	}
+
+	sent := 0
+	for sent < len(messages) {
+		n, err := conn.batch.WriteBatch(messages[sent:], 0)
+		if err != nil {
+			log.Printf("UDP Write Error: %v\n", err)
+			c.dropConn(conn)
+			return sent, err
+		}
+		sent += n
+	}
+
+	return sent, nil
+}
+
+// Send writes request and waits for response, for group targets the first answer of any member is returned
 func (c *UDPClient) Send(data []byte) (resp []byte, err error) {
-	_, err = c.conn.Write(data)
+	conn, err := c.dialedConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	if conn.group {
+		_, err = conn.conn.WriteToUDP(data, conn.addr)
+	} else {
+		_, err = conn.conn.Write(data)
+	}
 	if err != nil {
 		log.Printf("UDP Write Error: %v\n", err)
+		c.dropConn(conn)
+		return nil, err
 	}
 
-	if c.ignoreResponse {
+	if c.config.IgnoreResponse {
 		return nil, nil
 	}
 
 	resp = make([]byte, 4096)
-	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
-	respLength, err := c.conn.Read(resp)
+	conn.conn.SetReadDeadline(time.Now().Add(c.config.Timeout))
+	respLength, err := conn.conn.Read(resp)
 	if err != nil {
 		log.Printf("UDP Read Error: %v\n", err)
 	}
@@ -54,5 +372,5 @@ func (c *UDPClient) Send(data []byte) (resp []byte, err error) {
 		log.Printf("UDP Response may be truncated, length of response is %d\n", respLength)
 	}
 
-	return resp, err
+	return resp[:respLength], err
 }
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+const benchmarkBatchSize = 64
+
+// discardServer reads and drops datagrams on loopback until the test ends
+func discardServer(b *testing.B) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func newBenchmarkClient(b *testing.B) *UDPClient {
+	c := NewUDPClient(discardServer(b), &UDPClientConfig{Timeout: time.Second, IgnoreResponse: true})
+	b.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+// BenchmarkSend sends one request per syscall, ns/op is per request
+func BenchmarkSend(b *testing.B) {
+	c := newBenchmarkClient(b)
+	payload := make([]byte, 64)
+
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Send(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSendBatch sends benchmarkBatchSize requests per sendmmsg, ns/op is per request
+func BenchmarkSendBatch(b *testing.B) {
+	c := newBenchmarkClient(b)
+	payload := make([]byte, 64)
+
+	batch := make([][]byte, benchmarkBatchSize)
+	for i := range batch {
+		batch[i] = payload
+	}
+
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+
+	for sent := 0; sent < b.N; sent += len(batch) {
+		n := b.N - sent
+		if n > len(batch) {
+			n = len(batch)
+		}
+
+		if _, err := c.SendBatch(batch[:n]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
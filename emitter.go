@@ -1,37 +1,135 @@
 package main
 
 import (
+	"github.com/myzhan/goreplay-udp/proto"
 	"io"
+	"log"
+	"sync"
 	"time"
 )
 
+// drainer is implemented by outputs which queue data, Drain waits until it is processed or deadline passes
+type drainer interface {
+	Drain(deadline time.Time) bool
+}
+
+// responder is implemented by outputs which return data as readers only with some options
+type responder interface {
+	EmitsResponses() bool
+}
+
 // Start initialize loop for sending data from inputs to outputs
 func Start(stop chan int) {
+	var inputs, readers sync.WaitGroup
+
+	// Each output gets its own queue, shared by all inputs
+	queues := make([]*queuedOutput, len(Plugins.Outputs))
+	outputs := make([]io.Writer, len(Plugins.Outputs))
+	for i, out := range Plugins.Outputs {
+		queues[i] = newQueuedOutput(out, Settings.outputQueueSize, Settings.outputQueuePolicy)
+		outputs[i] = queues[i]
+	}
 
 	for _, in := range Plugins.Inputs {
-		go CopyMulty(in, Plugins.Outputs...)
+		inputs.Add(1)
+		go func(in io.Reader) {
+			CopyMulty(in, outputs...)
+			inputs.Done()
+		}(in)
 	}
 
-	for {
-		select {
-		case <-stop:
-			finalize()
-			return
-		case <-time.After(100 * time.Millisecond):
+	// Some outputs are readers as well, e.g. UDP output returns replayed responses.
+	// Limiter only applies to writes of such outputs.
+	for _, out := range Plugins.Outputs {
+		var plugin interface{} = out
+		if l, ok := out.(*Limiter); ok {
+			plugin = l.plugin
+		}
+
+		if r, ok := plugin.(responder); ok && !r.EmitsResponses() {
+			continue
+		}
+
+		if r, ok := plugin.(io.Reader); ok {
+			readers.Add(1)
+			go func() {
+				CopyMulty(r, outputs...)
+				readers.Done()
+			}()
 		}
 	}
+
+	<-stop
+	drain(&inputs, &readers, queues)
+	finalize()
 }
 
-// CopyMulty copies from 1 reader to multiple writers
+// drain stops inputs and waits until data already read by them goes through outputs, up to Settings.drainTimeout
+func drain(inputs, readers *sync.WaitGroup, queues []*queuedOutput) {
+	deadline := time.Now().Add(Settings.drainTimeout)
+
+	for _, in := range Plugins.Inputs {
+		if c, ok := in.(io.Closer); ok {
+			c.Close()
+		}
+	}
+
+	if !waitUntil(inputs, deadline) {
+		log.Println("Inputs are not drained before deadline")
+	}
+
+	for _, q := range queues {
+		q.Drain(deadline)
+	}
+
+	// Outputs which are readers return EOF once drained, e.g. UDP output after the last response
+	if !waitUntil(readers, deadline) {
+		log.Println("Output responses are not drained before deadline")
+	}
+
+	for _, q := range queues {
+		q.flush(deadline)
+	}
+}
+
+func waitUntil(wg *sync.WaitGroup, deadline time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Until(deadline)):
+		return false
+	}
+}
+
+// CopyMulty copies from 1 reader to multiple writers.
+// Buffer is reused for the next payload, so writers must copy payload they keep, like queuedOutput does.
 func CopyMulty(src io.Reader, writers ...io.Writer) (err error) {
+	var splitter *outputSplitter
+	if Settings.splitOutput {
+		if splitter, err = newOutputSplitter(Settings.splitOutputStrategy, Settings.splitOutputWeights, writers); err != nil {
+			log.Fatal("split-output: ", err)
+		}
+	}
+
 	buf := make([]byte, 5*1024*1024)
 	for {
 		nr, er := src.Read(buf)
 
 		if nr > 0 && len(buf) > nr {
 			payload := buf[:nr]
-			for _, dst := range writers {
-				dst.Write(payload)
+			// Only requests are split, every output gets responses, so diff and file outputs see both sides of a pair
+			if splitter != nil && proto.IsRequestPayload(payload) {
+				splitter.pick(payload).Write(payload)
+			} else {
+				for _, dst := range writers {
+					dst.Write(payload)
+				}
 			}
 		}
 
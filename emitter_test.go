@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/myzhan/goreplay-udp/input"
+	"github.com/myzhan/goreplay-udp/listener"
+	"github.com/myzhan/goreplay-udp/stats"
+)
+
+const benchmarkDatagrams = 10000
+
+// writeBenchmarkPcap writes DNS sized datagrams to port 53, all at the same time, so PcapInput doesn't wait between them
+func writeBenchmarkPcap(b *testing.B, size int) string {
+	b.Helper()
+
+	path := filepath.Join(b.TempDir(), "datagrams.pcap")
+	f, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		b.Fatal(err)
+	}
+
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IP{10, 0, 0, 1},
+		DstIP:    net.IP{10, 0, 0, 53},
+	}
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, gopacket.Payload(make([]byte, size))); err != nil {
+		b.Fatal(err)
+	}
+
+	data := buf.Bytes()
+	ci := gopacket.CaptureInfo{Timestamp: time.Unix(1, 0), CaptureLength: len(data), Length: len(data)}
+	for k := 0; k < benchmarkDatagrams; k++ {
+		if err := w.WritePacket(ci, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return path
+}
+
+type discardOutput struct{}
+
+func (discardOutput) Write(data []byte) (int, error) { return len(data), nil }
+
+// BenchmarkPcapCopyMulty measures capture pipeline from pcap file to outputs, run it on revisions before and after
+// pooled packet buffers and compare with benchstat
+func BenchmarkPcapCopyMulty(b *testing.B) {
+	for _, size := range []int{64, 512, 1400} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			path := writeBenchmarkPcap(b, size)
+			config := &listener.CaptureConfig{
+				DefragTimeout:      time.Second,
+				DefragMemoryLimit:  1,
+				PacketQueueSize:    10000,
+				PacketQueuePolicy:  stats.QueueBlock,
+				MessageQueueSize:   10000,
+				MessageQueuePolicy: stats.QueueBlock,
+			}
+
+			log.SetOutput(ioutil.Discard)
+			defer log.SetOutput(os.Stderr)
+
+			b.SetBytes(int64(size * benchmarkDatagrams))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for n := 0; n < b.N; n++ {
+				if err := CopyMulty(input.NewPcapInput(path, ":53", config), discardOutput{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*benchmarkDatagrams), "ns/datagram")
+		})
+	}
+}
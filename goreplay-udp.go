@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -27,21 +28,30 @@ func main() {
 		log.Fatal("Required at least 1 input and 1 output")
 	}
 
-	c := make(chan os.Signal, 1)
+	closeCh = make(chan int)
+	var stopOnce sync.Once
+	stop := func() {
+		stopOnce.Do(func() { close(closeCh) })
+	}
+
+	// The first signal drains queued data, the second one exits immediately
+	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		finalize()
+		log.Println("Stopping gor, draining for up to", Settings.drainTimeout)
+		stop()
+
+		<-c
 		os.Exit(1)
 	}()
 
 	if Settings.exitAfter > 0 {
 		log.Println("Running gor for a duration of", Settings.exitAfter)
-		closeCh = make(chan int)
 
 		time.AfterFunc(Settings.exitAfter, func() {
 			log.Println("Stopping gor after", Settings.exitAfter)
-			close(closeCh)
+			stop()
 		})
 	}
 
@@ -21,9 +21,40 @@ type fileInputReader struct {
 	data      []byte
 	file      *os.File
 	timestamp int64
+	// Length prefixed records, otherwise legacy format with PayloadSeparator
+	records bool
 }
 
 func (f *fileInputReader) parseNext() error {
+	if f.records {
+		return f.parseNextRecord()
+	}
+
+	return f.parseNextLegacy()
+}
+
+func (f *fileInputReader) parseNextRecord() error {
+	payload, err := proto.ReadRecord(f.reader)
+	if err != nil {
+		if err != io.EOF {
+			log.Println(err)
+		}
+
+		f.file.Close()
+		f.file = nil
+		return err
+	}
+
+	meta := proto.PayloadMeta(payload)
+	if len(meta) > 2 {
+		f.timestamp, _ = strconv.ParseInt(string(meta[2]), 10, 64)
+	}
+	f.data = payload
+
+	return nil
+}
+
+func (f *fileInputReader) parseNextLegacy() error {
 	payloadSeparatorAsBytes := []byte(proto.PayloadSeparator)
 	var buffer bytes.Buffer
 
@@ -55,8 +86,6 @@ func (f *fileInputReader) parseNext() error {
 
 		buffer.Write(line)
 	}
-
-	return nil
 }
 
 func (f *fileInputReader) ReadPayload() []byte {
@@ -85,6 +114,7 @@ func NewFileInputReader(path string) *fileInputReader {
 		gzReader, err := gzip.NewReader(file)
 		if err != nil {
 			log.Println(err)
+			file.Close()
 			return nil
 		}
 		r.reader = bufio.NewReader(gzReader)
@@ -92,6 +122,12 @@ func NewFileInputReader(path string) *fileInputReader {
 		r.reader = bufio.NewReader(file)
 	}
 
+	if r.records, err = proto.ReadFileHeader(r.reader); err != nil {
+		log.Println(path, err)
+		file.Close()
+		return nil
+	}
+
 	r.parseNext()
 
 	return r
@@ -158,7 +194,10 @@ func (i *FileInput) init() (err error) {
 }
 
 func (i *FileInput) Read(data []byte) (int, error) {
-	buf := <-i.data
+	buf, ok := <-i.data
+	if !ok {
+		return 0, io.EOF
+	}
 	copy(data, buf)
 
 	return len(buf), nil
@@ -187,9 +226,12 @@ func (i *FileInput) nextReader() (next *fileInputReader) {
 func (i *FileInput) emit() {
 	var lastTime int64 = -1
 
+	defer close(i.data)
+
 	for {
 		select {
 		case <-i.exit:
+			i.closeReaders()
 			return
 		default:
 		}
@@ -214,7 +256,12 @@ func (i *FileInput) emit() {
 				diff = int64(float64(diff) / i.SpeedFactor)
 			}
 
-			time.Sleep(time.Duration(diff))
+			select {
+			case <-i.exit:
+				i.closeReaders()
+				return
+			case <-time.After(time.Duration(diff)):
+			}
 		} else {
 			lastTime = reader.timestamp
 		}
@@ -225,15 +272,24 @@ func (i *FileInput) emit() {
 	log.Printf("FileInput: end of file '%s'\n", i.path)
 }
 
+// Close stops reading files, already read payloads are still returned by Read
 func (i *FileInput) Close() error {
+	select {
+	case i.exit <- true:
+	default:
+	}
+
+	return nil
+}
+
+// closeReaders is called by emit, so files are not closed in the middle of reading
+func (i *FileInput) closeReaders() {
 	defer i.mu.Unlock()
 	i.mu.Lock()
 
-	i.exit <- true
-
 	for _, r := range i.readers {
-		r.Close()
+		if r != nil {
+			r.Close()
+		}
 	}
-
-	return nil
 }
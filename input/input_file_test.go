@@ -0,0 +1,79 @@
+package input
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/myzhan/goreplay-udp/proto"
+)
+
+var testPayloads = []string{
+	"1 f45590522cd1838b4a0d5c5aab80b77929dea3b3 1231 53\nfirst",
+	"1 a45590522cd1838b4a0d5c5aab80b77929dea3b3 1232 53\nsecond\nline",
+}
+
+func writeTestFile(t *testing.T, data []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "requests.gor")
+	if err := ioutil.WriteFile(path, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func readAll(t *testing.T, path string, records bool) {
+	t.Helper()
+
+	r := NewFileInputReader(path)
+	if r == nil {
+		t.Fatal("file is not opened")
+	}
+	defer r.Close()
+
+	if r.records != records {
+		t.Errorf("expected records %v, got %v", records, r.records)
+	}
+
+	for i, expected := range testPayloads {
+		if r.timestamp != int64(1231+i) {
+			t.Errorf("payload %d: timestamp %d", i, r.timestamp)
+		}
+		if payload := r.ReadPayload(); string(payload) != expected {
+			t.Errorf("payload %d: read %q, expected %q", i, payload, expected)
+		}
+	}
+
+	// File is closed once the last payload is read
+	if r.file != nil {
+		t.Error("expected end of file")
+	}
+}
+
+func TestFileInputReaderRecords(t *testing.T) {
+	var buf bytes.Buffer
+	proto.WriteFileHeader(&buf)
+	for _, payload := range testPayloads {
+		proto.WriteRecord(&buf, []byte(payload))
+	}
+
+	readAll(t, writeTestFile(t, buf.Bytes()), true)
+}
+
+func TestFileInputReaderLegacy(t *testing.T) {
+	var buf bytes.Buffer
+	for _, payload := range testPayloads {
+		buf.WriteString(payload + proto.PayloadSeparator)
+	}
+
+	readAll(t, writeTestFile(t, buf.Bytes()), false)
+}
+
+func TestFileInputReaderUnknownVersion(t *testing.T) {
+	if r := NewFileInputReader(writeTestFile(t, append(proto.FileMagic, 2))); r != nil {
+		t.Error("file of unknown format version is read")
+	}
+}
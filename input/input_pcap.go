@@ -0,0 +1,115 @@
+package input
+
+import (
+	"github.com/myzhan/goreplay-udp/listener"
+	"github.com/myzhan/goreplay-udp/proto"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// PcapInput replays UDP traffic from .pcap and .pcapng files, e.g. captured by tcpdump
+type PcapInput struct {
+	data        chan *proto.UDPMessage
+	exit        chan bool
+	path        string
+	address     string
+	listener    *listener.UDPListener
+	config      *listener.CaptureConfig
+	SpeedFactor float64
+}
+
+// NewPcapInput constructor for PcapInput. Accepts file path and address to filter, like `:53`
+func NewPcapInput(path string, address string, config *listener.CaptureConfig) (i *PcapInput) {
+	i = new(PcapInput)
+	i.data = make(chan *proto.UDPMessage, 1000)
+	i.exit = make(chan bool, 1)
+	i.path = path
+	i.address = address
+	i.config = config
+	i.SpeedFactor = 1
+
+	log.Println("Reading pcap file: " + path + ", filter: " + address)
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		log.Fatal("input-pcap: error while parsing address", err)
+	}
+
+	i.listener = listener.NewUDPFileListener(path, host, port, config)
+
+	go i.emit()
+
+	return
+}
+
+func (i *PcapInput) Read(data []byte) (int, error) {
+	msg, ok := <-i.data
+	if !ok {
+		return 0, io.EOF
+	}
+	defer msg.Release()
+
+	return writeMessage(data, msg), nil
+}
+
+func (i *PcapInput) String() string {
+	return "Pcap input: " + i.path
+}
+
+// emit keeps original intervals between packets, scaled by SpeedFactor
+func (i *PcapInput) emit() {
+	var lastTime int64 = -1
+
+	ch := i.listener.Receiver()
+	defer close(i.data)
+
+	for {
+		var msg *proto.UDPMessage
+		var ok bool
+
+		select {
+		case <-i.exit:
+			return
+		case msg, ok = <-ch:
+		}
+
+		if !ok {
+			break
+		}
+
+		timestamp := msg.Start.UnixNano()
+
+		if lastTime != -1 {
+			diff := timestamp - lastTime
+			lastTime = timestamp
+
+			if i.SpeedFactor != 1 {
+				diff = int64(float64(diff) / i.SpeedFactor)
+			}
+
+			select {
+			case <-i.exit:
+				return
+			case <-time.After(time.Duration(diff)):
+			}
+		} else {
+			lastTime = timestamp
+		}
+
+		i.data <- msg
+	}
+
+	log.Printf("PcapInput: end of file '%s'\n", i.path)
+}
+
+// Close stops reading the file, already read messages are still returned by Read
+func (i *PcapInput) Close() error {
+	select {
+	case i.exit <- true:
+	default:
+	}
+
+	return i.listener.Close()
+}
@@ -3,44 +3,70 @@ package input
 import (
 	"github.com/myzhan/goreplay-udp/listener"
 	"github.com/myzhan/goreplay-udp/proto"
+	"io"
 	"log"
 	"net"
+	"strconv"
 )
 
+// newUDPListener starts capture, tests replace it to read a pcap file
+var newUDPListener = listener.NewUDPListener
+
 type UDPInput struct {
-	data          chan *proto.UDPMessage
-	address       string
-	quit          chan bool
-	listener      *listener.UDPListener
-	trackResponse bool
+	data     chan *proto.UDPMessage
+	address  string
+	listener *listener.UDPListener
+	config   *listener.CaptureConfig
 }
 
-func NewUDPInput(address string, trackResponse bool) (i *UDPInput) {
+func NewUDPInput(address string, config *listener.CaptureConfig) (i *UDPInput) {
 	i = new(UDPInput)
 	i.data = make(chan *proto.UDPMessage)
 	i.address = address
-	i.quit = make(chan bool)
-	i.trackResponse = trackResponse
+	i.config = config
 	i.listen(address)
 	return
 }
 
 func (i *UDPInput) Read(data []byte) (int, error) {
-	msg := <-i.data
-	buf := msg.Data()
+	msg, ok := <-i.data
+	if !ok {
+		return 0, io.EOF
+	}
+	defer msg.Release()
 
-	var header []byte
+	return writeMessage(data, msg), nil
+}
 
+// writeMessage puts header and body of UDP message into data, returns written length.
+// Message buffer is still owned by caller.
+func writeMessage(data []byte, msg *proto.UDPMessage) int {
+	buf := msg.Data()
+
+	payloadType := byte(proto.ResponsePayload)
 	if msg.IsIncoming {
-		header = proto.PayloadHeader(proto.RequestPayload, msg.UUID(), msg.Start.UnixNano())
-	} else {
-		header = proto.PayloadHeader(proto.ResponsePayload, msg.UUID(), msg.Start.UnixNano())
+		payloadType = proto.RequestPayload
 	}
 
+	var latency string
+	if msg.Latency > 0 {
+		latency = strconv.FormatInt(msg.Latency.Nanoseconds(), 10)
+	}
+
+	header := proto.PayloadExtendedHeader(payloadType, msg.UUID(), msg.Start.UnixNano(), msg.ListenPort,
+		proto.MetaClient, msg.ClientAddr().String(),
+		proto.MetaServer, msg.ServerAddr().String(),
+		proto.MetaInterface, msg.Interface,
+		proto.MetaTTL, strconv.Itoa(int(msg.TTL)),
+		proto.MetaTOS, strconv.Itoa(int(msg.TOS)),
+		proto.MetaEncap, msg.Encapsulation,
+		proto.MetaLatency, latency,
+	)
+
 	copy(data[0:len(header)], header)
 	copy(data[len(header):], buf)
 
-	return len(buf) + len(header), nil
+	return len(buf) + len(header)
 }
 
 func (i *UDPInput) listen(address string) {
@@ -52,20 +78,24 @@ func (i *UDPInput) listen(address string) {
 		log.Fatal("input-raw: error while parsing address", err)
 	}
 
-	i.listener = listener.NewUDPListener(host, port, i.trackResponse)
+	i.listener = newUDPListener(host, port, i.config)
 
 	ch := i.listener.Receiver()
 
 	go func() {
-		for {
-			select {
-			case <-i.quit:
-				return
-			default:
-			}
-			// Receiving UDPMessage
-			m := <-ch
+		// Receiving UDPMessage
+		for m := range ch {
 			i.data <- m
 		}
+		close(i.data)
 	}()
 }
+
+// Close stops capture, messages captured before are still returned by Read
+func (i *UDPInput) Close() error {
+	return i.listener.Close()
+}
+
+func (i *UDPInput) String() string {
+	return "UDP input: " + i.address
+}
@@ -0,0 +1,172 @@
+package input
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/myzhan/goreplay-udp/listener"
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/myzhan/goreplay-udp/stats"
+)
+
+const testBodySize = 200
+
+// writeTestPcap writes datagrams to port 53, body is sequence number and bytes derived from it
+func writeTestPcap(t *testing.T, count int) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "datagrams.pcap")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IP{10, 0, 0, 1},
+		DstIP:    net.IP{10, 0, 0, 53},
+	}
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+
+	body := make([]byte, testBodySize)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+
+	for seq := 0; seq < count; seq++ {
+		binary.BigEndian.PutUint64(body, uint64(seq))
+		for k := 8; k < len(body); k++ {
+			body[k] = byte(seq + k)
+		}
+
+		if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, gopacket.Payload(body)); err != nil {
+			t.Fatal(err)
+		}
+
+		data := buf.Bytes()
+		ci := gopacket.CaptureInfo{Timestamp: time.Unix(0, int64(seq)), CaptureLength: len(data), Length: len(data)}
+		if err := w.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return path
+}
+
+// checkBody returns sequence number of body written by writeTestPcap, or fails if body is damaged
+func checkBody(t *testing.T, body []byte) int {
+	t.Helper()
+
+	if len(body) != testBodySize {
+		t.Fatalf("expected body of %d bytes, got %d", testBodySize, len(body))
+	}
+
+	seq := int(binary.BigEndian.Uint64(body))
+	for k := 8; k < len(body); k++ {
+		if body[k] != byte(seq+k) {
+			t.Fatalf("body of datagram %d is damaged at byte %d", seq, k)
+		}
+	}
+
+	return seq
+}
+
+// TestUDPInputQueuePolicies passes datagrams from capture through full queues to Read, run it with -race
+func TestUDPInputQueuePolicies(t *testing.T) {
+	for _, policy := range []string{stats.QueueBlock, stats.QueueDropNewest, stats.QueueDropOldest} {
+		t.Run(policy, func(t *testing.T) {
+			testUDPInputQueuePolicy(t, policy)
+		})
+	}
+}
+
+func testUDPInputQueuePolicy(t *testing.T, policy string) {
+	const count = 20000
+
+	config := &listener.CaptureConfig{
+		DefragTimeout:      time.Second,
+		DefragMemoryLimit:  1,
+		PacketQueueSize:    16,
+		PacketQueuePolicy:  policy,
+		MessageQueueSize:   16,
+		MessageQueuePolicy: policy,
+	}
+
+	path := writeTestPcap(t, count)
+
+	defer func(f func(string, string, *listener.CaptureConfig) *listener.UDPListener) { newUDPListener = f }(newUDPListener)
+	newUDPListener = func(host, port string, config *listener.CaptureConfig) *listener.UDPListener {
+		return listener.NewUDPFileListener(path, host, port, config)
+	}
+
+	i := NewUDPInput(":53", config)
+	defer i.Close()
+
+	// File is read faster than messages are, queues overflow while nothing is read
+	if policy != stats.QueueBlock {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	buf := make([]byte, 64*1024)
+	first, last, received := -1, -1, 0
+
+	for {
+		n, err := i.Read(buf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		seq := checkBody(t, proto.PayloadBody(buf[:n]))
+		if seq <= last {
+			t.Fatalf("datagram %d is read after %d", seq, last)
+		}
+		if first == -1 {
+			first = seq
+		}
+		last = seq
+		received++
+
+		// Slow reader keeps queues full
+		if received%256 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	switch policy {
+	case stats.QueueBlock:
+		if received != count {
+			t.Errorf("expected %d datagrams, got %d", count, received)
+		}
+	case stats.QueueDropNewest:
+		if received >= count || first != 0 {
+			t.Errorf("expected newest datagrams dropped, got %d from %d", received, first)
+		}
+	case stats.QueueDropOldest:
+		if received >= count || last != count-1 {
+			t.Errorf("expected oldest datagrams dropped, got %d up to %d", received, last)
+		}
+	}
+}
@@ -41,17 +41,25 @@ func NewLimiter(plugin interface{}, options string) io.ReadWriter {
 	l.currentTime = time.Now().UnixNano()
 
 	// FileInput have its own rate limiting. Unlike other inputs we not just dropping requests, we can slow down or speed up request emittion.
-	if fi, ok := l.plugin.(*input.FileInput); ok && l.isPercent {
-		fi.SpeedFactor = float64(l.limit) / float64(100)
+	if l.isPercent {
+		switch in := l.plugin.(type) {
+		case *input.FileInput:
+			in.SpeedFactor = float64(l.limit) / float64(100)
+		case *input.PcapInput:
+			in.SpeedFactor = float64(l.limit) / float64(100)
+		}
 	}
 
 	return l
 }
 
 func (l *Limiter) isLimited() bool {
-	// File input have its own limiting algorithm
-	if _, ok := l.plugin.(*input.FileInput); ok && l.isPercent {
-		return false
+	// File and pcap inputs have their own limiting algorithm
+	if l.isPercent {
+		switch l.plugin.(type) {
+		case *input.FileInput, *input.PcapInput:
+			return false
+		}
 	}
 
 	if l.isPercent {
@@ -89,13 +97,30 @@ func (l *Limiter) Read(data []byte) (n int, err error) {
 		return 0, nil
 	}
 
-	if l.isLimited() {
+	if err == nil && l.isLimited() {
 		return 0, nil
 	}
 
 	return
 }
 
+// Drain passes to the plugin, limiter doesn't buffer anything itself
+func (l *Limiter) Drain(deadline time.Time) bool {
+	if d, ok := l.plugin.(drainer); ok {
+		return d.Drain(deadline)
+	}
+
+	return true
+}
+
+func (l *Limiter) Close() error {
+	if c, ok := l.plugin.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
 func (l *Limiter) String() string {
 	return fmt.Sprintf("Limiting %s to: %d (isPercent: %v)", l.plugin, l.limit, l.isPercent)
 }
@@ -0,0 +1,317 @@
+package listener
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Ring of each socket: 128 blocks of 1MB
+const (
+	afPacketBlockSize = 1 << 20
+	afPacketNumBlocks = 128
+)
+
+const (
+	afPacketFanout = afpacket.FanoutHash | afpacket.FanoutHashWithDefrag
+	// Fanout group ids tried before giving up, they are shared by all processes
+	afPacketFanoutTries = 1024
+)
+
+// Pause between reads after an error, doubled while errors repeat
+const (
+	afPacketMinBackoff = 10 * time.Millisecond
+	afPacketMaxBackoff = time.Second
+)
+
+// readAFPacket captures from memory mapped TPACKET_V3 rings. Each interface is shared by Fanout sockets
+// with own goroutines, kernel hashes flows to sockets after defragmentation, so flow order is kept.
+func (l *IPListener) readAFPacket() {
+	devices, err := findPcapDevices(l.addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	workers := l.config.Fanout
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	var captured int
+
+	for _, device := range devices {
+		linkType, err := afPacketLinkType(device.Name)
+		if err != nil {
+			if len(devices) == 1 {
+				log.Fatal(err)
+			}
+
+			log.Println("AF_PACKET skips device:", err)
+			continue
+		}
+
+		filter, err := l.afPacketFilter(device, devices, linkType)
+		if err != nil {
+			log.Println("BPF filter error:", err, "Device:", device.Name)
+			continue
+		}
+
+		// Mirror ports get traffic of other hosts, pcap engine captures it in promiscuous mode too
+		promisc, err := setPromisc(device.Name)
+		if err != nil {
+			log.Println("AF_PACKET can't enable promiscuous mode:", err, "Device:", device.Name)
+		}
+
+		handles, err := openTPackets(device.Name, filter, workers)
+		if err != nil {
+			log.Println("AF_PACKET error while opening device", device.Name, err)
+		}
+		if len(handles) == 0 {
+			if promisc != -1 {
+				unix.Close(promisc)
+			}
+			continue
+		}
+
+		for _, handle := range handles {
+			go l.readTPacket(handle, device.Name, linkType)
+		}
+		captured++
+
+		// Promiscuous mode lasts until capture stops
+		if promisc != -1 {
+			go l.closeOnStop(promisc)
+		}
+	}
+
+	if captured == 0 {
+		log.Fatal("AF_PACKET can't capture any device of ", l.addr)
+	}
+
+	l.readyChan <- true
+}
+
+// openTPackets opens sockets of one fanout group. Sockets opened before an error are returned,
+// they capture all packets of the interface between them.
+func openTPackets(name string, filter []bpf.RawInstruction, workers int) (handles []*afpacket.TPacket, err error) {
+	var group uint16
+
+	for w := 0; w < workers; w++ {
+		handle, err := afpacket.NewTPacket(
+			afpacket.OptInterface(name),
+			afpacket.TPacketVersion3,
+			afpacket.OptFrameSize(afpacket.DefaultFrameSize),
+			afpacket.OptBlockSize(afPacketBlockSize),
+			afpacket.OptNumBlocks(afPacketNumBlocks),
+			afpacket.OptPollTimeout(time.Second),
+		)
+		if err != nil {
+			return handles, err
+		}
+
+		if err := handle.SetBPF(filter); err != nil {
+			handle.Close()
+			return handles, fmt.Errorf("BPF filter error: %v", err)
+		}
+
+		if workers > 1 {
+			if w == 0 {
+				group, err = joinNewFanout(handle, name)
+			} else {
+				err = handle.SetFanout(afPacketFanout, group)
+			}
+
+			if err != nil {
+				handle.Close()
+				return handles, fmt.Errorf("fanout error: %v", err)
+			}
+		}
+
+		handles = append(handles, handle)
+	}
+
+	return handles, nil
+}
+
+// afPacketLinkType maps hardware type of interface to link type of packets read from its AF_PACKET socket
+func afPacketLinkType(name string) (layers.LinkType, error) {
+	if name == "any" || isNFLogDevice(name) {
+		return 0, fmt.Errorf("%s is not a network interface, capture it with pcap engine", name)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join("/sys/class/net", name, "type"))
+	if err != nil {
+		return 0, fmt.Errorf("%s: can't get hardware type: %v", name, err)
+	}
+
+	hwType, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("%s: can't get hardware type: %v", name, err)
+	}
+
+	switch hwType {
+	case unix.ARPHRD_ETHER, unix.ARPHRD_LOOPBACK:
+		return layers.LinkTypeEthernet, nil
+	case unix.ARPHRD_NONE, unix.ARPHRD_RAWIP:
+		// Tunnels like tun and wireguard have no link header
+		return layers.LinkTypeRaw, nil
+	}
+
+	return 0, fmt.Errorf("%s: hardware type %d is not supported by AF_PACKET engine, capture it with pcap engine", name, hwType)
+}
+
+// joinNewFanout joins handle to a fanout group no other socket uses and returns its id.
+// Ids are shared by all processes, and a socket joins existing group of the same interface and type silently,
+// so each id is probed first by a socket with other fanout type, which fails if the group exists.
+func joinNewFanout(handle *afpacket.TPacket, name string) (uint16, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, err
+	}
+
+	id := uint16(os.Getpid()) ^ uint16(iface.Index)<<8
+
+	for i := 0; i < afPacketFanoutTries; i, id = i+1, id+1 {
+		if used, err := fanoutUsed(id); err != nil {
+			return 0, err
+		} else if used {
+			continue
+		}
+
+		// Probe could join a group of the other type, then the handle fails to join it
+		if err := handle.SetFanout(afPacketFanout, id); err == nil {
+			return id, nil
+		} else if err != unix.EINVAL {
+			return 0, err
+		}
+	}
+
+	return 0, fmt.Errorf("no free fanout group id after %d tries", afPacketFanoutTries)
+}
+
+// fanoutUsed checks if fanout group exists. Group created by the probe is removed when it closes.
+func fanoutUsed(id uint16) (bool, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return false, err
+	}
+	defer unix.Close(fd)
+
+	err = unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_FANOUT, unix.PACKET_FANOUT_LB<<16|int(id))
+	if err == unix.EINVAL {
+		return true, nil
+	}
+
+	return false, err
+}
+
+func htons(i uint16) uint16 {
+	return (i<<8)&0xff00 | i>>8
+}
+
+// afPacketFilter compiles the same filter as pcap engine uses. Loopback interface shows each packet
+// twice, as outgoing and incoming, so outgoing copies are skipped.
+func (l *IPListener) afPacketFilter(device pcap.Interface, devices []pcap.Interface, linkType layers.LinkType) ([]bpf.RawInstruction, error) {
+	expr := l.bpfFilter(l.deviceHosts(device, devices))
+	if isLoopback(device) {
+		expr = "inbound and (" + expr + ")"
+	}
+
+	snaplen := 65536
+	if it, err := net.InterfaceByName(device.Name); err == nil {
+		snaplen = it.MTU + 68*2
+	}
+
+	instructions, err := pcap.CompileBPFFilter(linkType, snaplen, expr)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]bpf.RawInstruction, len(instructions))
+	for i, ins := range instructions {
+		raw[i] = bpf.RawInstruction{Op: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+
+	return raw, nil
+}
+
+// setPromisc enables promiscuous mode of interface while returned socket is open.
+// TPacket doesn't expose its socket, so membership is added to a separate one, which receives no packets.
+func setPromisc(name string) (int, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return -1, err
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		return -1, err
+	}
+
+	mreq := unix.PacketMreq{Ifindex: int32(iface.Index), Type: unix.PACKET_MR_PROMISC}
+	if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &mreq); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+
+	return fd, nil
+}
+
+func (l *IPListener) closeOnStop(fd int) {
+	for atomic.LoadInt32(&l.closed) == 0 {
+		time.Sleep(time.Second)
+	}
+
+	unix.Close(fd)
+}
+
+func (l *IPListener) readTPacket(handle *afpacket.TPacket, iface string, linkType layers.LinkType) {
+	defer handle.Close()
+
+	decoder := linkDecoder(linkType)
+
+	// Errors repeat while interface is down, reads back off and only the first error of a series is logged
+	var backoff time.Duration
+
+	for atomic.LoadInt32(&l.closed) == 0 {
+		// Data points to the ring until the next read, handlePacket copies it
+		data, ci, err := handle.ZeroCopyReadPacketData()
+		if err == afpacket.ErrTimeout {
+			backoff = 0
+			continue
+		} else if err == unix.EBADF {
+			log.Println("AF_PACKET socket is closed, stop reading device", iface)
+			return
+		} else if err != nil {
+			if backoff == 0 {
+				log.Println("AF_PACKET read error:", err, "Device:", iface)
+				backoff = afPacketMinBackoff
+			} else if backoff < afPacketMaxBackoff {
+				backoff *= 2
+			}
+
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		packet := gopacket.NewPacket(data, decoder, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		packet.Metadata().CaptureInfo = ci
+
+		l.handlePacket(packet, iface)
+	}
+}
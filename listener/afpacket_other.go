@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package listener
+
+import "log"
+
+func (l *IPListener) readAFPacket() {
+	log.Fatal("af_packet capture engine is available on Linux only")
+}
@@ -0,0 +1,85 @@
+package listener
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"strconv"
+	"strings"
+)
+
+// bpfTunnels matches outer headers of GRE, VXLAN and GENEVE tunnels, inner packets are checked after decoding
+const bpfTunnels = "ip proto 47 or ip6 proto 47 or udp dst port 4789 or udp dst port 6081"
+
+// bpfDecap extends filter to tunnels, and to the same packets with VLAN tag.
+// `vlan` primitive shifts offsets for the rest of expression, so it goes last.
+func bpfDecap(filter string) string {
+	filter = "(" + filter + ") or " + bpfTunnels
+	return filter + " or (vlan and (" + filter + "))"
+}
+
+// ParseIDs parses comma separated VLAN IDs or VNIs, empty spec gives nil
+func ParseIDs(spec string, max uint64) (ids map[uint32]bool, err error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	ids = make(map[uint32]bool)
+	for _, item := range strings.Split(spec, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(item), 10, 32)
+		if err != nil || id > max {
+			return nil, fmt.Errorf("invalid ID %q, should be from 0 to %d", item, max)
+		}
+		ids[uint32(id)] = true
+	}
+
+	return ids, nil
+}
+
+// decapsulate returns network layer of the innermost packet found through up to DecapDepth VLAN tags and tunnels,
+// and encapsulation path like `vlan:10,vxlan:42`. ok is false if packet doesn't pass VLAN or VNI filter,
+// or it is nested deeper than DecapDepth.
+func (l *IPListener) decapsulate(packet gopacket.Packet) (network gopacket.NetworkLayer, encap string, ok bool) {
+	if l.config.DecapDepth <= 0 {
+		return packet.NetworkLayer(), "", true
+	}
+
+	var path []string
+	vlanMatched := l.vlans == nil
+	vniMatched := l.vnis == nil
+
+	for _, layer := range packet.Layers() {
+		switch layer.LayerType() {
+		case layers.LayerTypeIPv4, layers.LayerTypeIPv6:
+			network = layer.(gopacket.NetworkLayer)
+			continue
+		case layers.LayerTypeDot1Q, layers.LayerTypeGRE, layers.LayerTypeVXLAN, layers.LayerTypeGeneve:
+			// Payload of the last found packet is a tunnel, not a datagram
+			if len(path) == l.config.DecapDepth {
+				return nil, "", false
+			}
+		default:
+			continue
+		}
+
+		switch layer := layer.(type) {
+		case *layers.Dot1Q:
+			path = append(path, "vlan:"+strconv.Itoa(int(layer.VLANIdentifier)))
+			vlanMatched = vlanMatched || l.vlans[uint32(layer.VLANIdentifier)]
+		case *layers.GRE:
+			step := "gre"
+			if layer.KeyPresent {
+				step += ":" + strconv.FormatUint(uint64(layer.Key), 10)
+			}
+			path = append(path, step)
+		case *layers.VXLAN:
+			path = append(path, "vxlan:"+strconv.FormatUint(uint64(layer.VNI), 10))
+			vniMatched = vniMatched || l.vnis[layer.VNI]
+		case *layers.Geneve:
+			path = append(path, "geneve:"+strconv.FormatUint(uint64(layer.VNI), 10))
+			vniMatched = vniMatched || l.vnis[layer.VNI]
+		}
+	}
+
+	return network, strings.Join(path, ","), vlanMatched && vniMatched
+}
@@ -0,0 +1,207 @@
+package listener
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+func TestDecapsulate(t *testing.T) {
+	tests := []struct {
+		fixture string
+		depth   int
+		src     string
+		port    uint16
+		encap   string
+	}{
+		{"vlan.pcap", 1, "192.168.0.1", 53, "vlan:10"},
+		{"gre_key.pcap", 1, "192.168.0.1", 53, "gre:7"},
+		{"vxlan.pcap", 2, "192.168.0.1", 53, "vlan:20,vxlan:42"},
+		{"geneve.pcap", 1, "192.168.0.1", 53, "geneve:77"},
+		// Without decapsulation tunnel datagrams are captured as they are
+		{"vxlan.pcap", 0, "172.16.0.1", 4789, ""},
+		{"geneve.pcap", 0, "2001:db8::1", 6081, ""},
+	}
+
+	for _, tt := range tests {
+		packet, udp := captureOne(t, &CaptureConfig{DecapDepth: tt.depth}, tt.fixture)
+
+		if !net.IP(packet.srcIP).Equal(net.ParseIP(tt.src)) {
+			t.Errorf("%s, depth %d: source %v, expected %s", tt.fixture, tt.depth, net.IP(packet.srcIP), tt.src)
+		}
+		if uint16(udp.DstPort) != tt.port {
+			t.Errorf("%s, depth %d: port %d, expected %d", tt.fixture, tt.depth, udp.DstPort, tt.port)
+		}
+		if packet.encap != tt.encap {
+			t.Errorf("%s, depth %d: encapsulation %q, expected %q", tt.fixture, tt.depth, packet.encap, tt.encap)
+		}
+		if tt.port == 53 && string(udp.Payload) != "inner" {
+			t.Errorf("%s, depth %d: payload %q", tt.fixture, tt.depth, udp.Payload)
+		}
+	}
+}
+
+func TestDecapsulateDropped(t *testing.T) {
+	tests := []struct {
+		fixture string
+		depth   int
+	}{
+		// Nested deeper than depth, the last packet found holds a tunnel, not a datagram
+		{"vxlan.pcap", 1},
+		// GRE is not UDP
+		{"gre_key.pcap", 0},
+		// BPF passes any tunnel, inner packet is TCP
+		{"vxlan_tcp.pcap", 1},
+		{"vxlan_tcp.pcap", 2},
+	}
+
+	for _, tt := range tests {
+		packets := capture(t, newTestListener(&CaptureConfig{DecapDepth: tt.depth}), tt.fixture)
+		if len(packets) != 0 {
+			t.Errorf("%s, depth %d: expected no packets, got %d", tt.fixture, tt.depth, len(packets))
+		}
+	}
+}
+
+func TestDecapsulateFilters(t *testing.T) {
+	tests := []struct {
+		fixture string
+		vlan    string
+		vni     string
+		matched bool
+	}{
+		{"vlan.pcap", "10", "", true},
+		{"vlan.pcap", "5,10", "", true},
+		{"vlan.pcap", "11", "", false},
+		// Packet outside of any tunnel doesn't match VNI
+		{"vlan.pcap", "", "42", false},
+		{"vxlan.pcap", "20", "42", true},
+		{"vxlan.pcap", "", "43", false},
+		{"vxlan.pcap", "21", "42", false},
+		{"geneve.pcap", "", "77", true},
+		// GRE key isn't VNI
+		{"gre_key.pcap", "", "7", false},
+	}
+
+	for _, tt := range tests {
+		config := &CaptureConfig{DecapDepth: 2, VLAN: tt.vlan, VNI: tt.vni}
+		packets := capture(t, newTestListener(config), tt.fixture)
+
+		if matched := len(packets) == 1; matched != tt.matched {
+			t.Errorf("%s, vlan %q, vni %q: got %d packets, expected match %v", tt.fixture, tt.vlan, tt.vni, len(packets), tt.matched)
+		}
+	}
+}
+
+func TestParseIDs(t *testing.T) {
+	tests := []struct {
+		spec string
+		ids  map[uint32]bool
+		ok   bool
+	}{
+		{"", nil, true},
+		{"10", map[uint32]bool{10: true}, true},
+		{"0, 4095", map[uint32]bool{0: true, 4095: true}, true},
+		{"4096", nil, false},
+		{"-1", nil, false},
+		{"10,,20", nil, false},
+		{"vlan10", nil, false},
+	}
+
+	for _, tt := range tests {
+		ids, err := ParseIDs(tt.spec, 4095)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: unexpected error %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(ids, tt.ids) {
+			t.Errorf("%q: got %v, expected %v", tt.spec, ids, tt.ids)
+		}
+	}
+}
+
+func TestBPFDecap(t *testing.T) {
+	expected := "(udp dst port 53) or " + bpfTunnels + " or (vlan and ((udp dst port 53) or " + bpfTunnels + "))"
+	if filter := bpfDecap("udp dst port 53"); filter != expected {
+		t.Errorf("got %q, expected %q", filter, expected)
+	}
+
+	tests := []struct {
+		fixture string
+		depth   int
+		matched bool
+	}{
+		{"vlan.pcap", 1, true},
+		{"gre_key.pcap", 1, true},
+		{"vxlan.pcap", 1, true},
+		{"geneve.pcap", 1, true},
+		// Inner packet isn't checked, it is skipped after decoding
+		{"vxlan_tcp.pcap", 1, true},
+		// Tunnels and tagged packets are captured only with decapsulation
+		{"vlan.pcap", 0, false},
+		{"gre_key.pcap", 0, false},
+		{"vxlan.pcap", 0, false},
+		{"geneve.pcap", 0, false},
+	}
+
+	for _, tt := range tests {
+		packet := readFixture(t, tt.fixture)[0]
+
+		if matched := compileTestFilter(t, tt.depth).Matches(packet.Metadata().CaptureInfo, packet.Data()); matched != tt.matched {
+			t.Errorf("%s, depth %d: matched %v, expected %v", tt.fixture, tt.depth, matched, tt.matched)
+		}
+	}
+
+	// Untagged datagrams outside of tunnels are matched by port with any depth
+	for _, port := range []uint16{53, 5300} {
+		data := ethernetDatagram(t, port)
+		ci := gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}
+
+		for _, depth := range []int{0, 1} {
+			if matched := compileTestFilter(t, depth).Matches(ci, data); matched != (port == 53) {
+				t.Errorf("port %d, depth %d: matched %v", port, depth, matched)
+			}
+		}
+	}
+}
+
+// compileTestFilter compiles filter of listener for port 53 on any host, for Ethernet
+func compileTestFilter(t *testing.T, depth int) *pcap.BPF {
+	t.Helper()
+
+	l := newTestListener(&CaptureConfig{DecapDepth: depth})
+	l.ports, _ = ParsePorts("53")
+
+	bpf, err := pcap.NewBPF(layers.LinkTypeEthernet, 65536, l.bpfFilter("", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bpf
+}
+
+func ethernetDatagram(t *testing.T, port uint16) []byte {
+	t.Helper()
+
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, eth, gopacket.Payload(testDatagram(t, "eth"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Destination port follows 20 bytes of IPv4 header and source port, checksum isn't checked by BPF
+	data := buf.Bytes()
+	binary.BigEndian.PutUint16(data[14+20+2:], port)
+
+	return data
+}
@@ -0,0 +1,93 @@
+package listener
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// readFixture decodes packets of pcap file from testdata, the same way as readPcapFile does
+func readFixture(t *testing.T, name string) []gopacket.Packet {
+	t.Helper()
+
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := gopacket.NewPacketSource(r, linkDecoder(r.LinkType()))
+	source.Lazy = true
+
+	var packets []gopacket.Packet
+	for {
+		packet, err := source.NextPacket()
+		if err == io.EOF {
+			return packets
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		packets = append(packets, packet)
+	}
+}
+
+func newTestListener(config *CaptureConfig) *IPListener {
+	config.DefragTimeout = 30 * time.Second
+	config.DefragMemoryLimit = 1
+	config.PacketQueueSize = 100
+	config.PacketQueuePolicy = "block"
+
+	return newIPListener("", nil, config)
+}
+
+// capture passes packets of fixture to the listener and returns packets it queued
+func capture(t *testing.T, l *IPListener, name string) []*ipPacket {
+	t.Helper()
+
+	for _, packet := range readFixture(t, name) {
+		l.handlePacket(packet, "test0")
+	}
+
+	return queued(l)
+}
+
+// queued returns packets the listener queued so far
+func queued(l *IPListener) (packets []*ipPacket) {
+	for {
+		select {
+		case packet := <-l.ipPacketsChan:
+			packets = append(packets, packet)
+		default:
+			return packets
+		}
+	}
+}
+
+// captureOne expects fixture to give single UDP datagram and returns it
+func captureOne(t *testing.T, config *CaptureConfig, name string) (*ipPacket, *layers.UDP) {
+	t.Helper()
+
+	packets := capture(t, newTestListener(config), name)
+	if len(packets) != 1 {
+		t.Fatalf("%s: expected 1 packet, got %d", name, len(packets))
+	}
+
+	udp := &layers.UDP{}
+	if err := udp.DecodeFromBytes(packets[0].payload, gopacket.NilDecodeFeedback); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+
+	return packets[0], udp
+}
@@ -0,0 +1,183 @@
+package listener
+
+import (
+	"github.com/google/gopacket/layers"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Max size of reassembled IP payload
+	maxDatagramSize = 65535
+
+	defragReportInterval = 5 * time.Second
+)
+
+type fragmentKey struct {
+	src      string
+	dst      string
+	id       uint32
+	protocol layers.IPProtocol
+}
+
+type ipFragment struct {
+	key    fragmentKey
+	offset int
+	more   bool
+	data   []byte
+}
+
+type fragmentedDatagram struct {
+	fragments []ipFragment
+	// Total payload length, known once the last fragment arrives
+	size   int
+	memory int
+	start  time.Time
+}
+
+// ipDefragmenter reassembles fragmented IPv4 and IPv6 datagrams.
+// Capture timestamps are used as clock, so timeouts work the same for live capture and pcap files.
+type ipDefragmenter struct {
+	mu sync.Mutex
+
+	timeout     time.Duration
+	memoryLimit int
+	memory      int
+
+	datagrams map[fragmentKey]*fragmentedDatagram
+
+	lastCleanup time.Time
+	lastReport  time.Time
+
+	reassembled int
+	timedOut    int
+	dropped     int
+	reported    int
+}
+
+func newIPDefragmenter(timeout time.Duration, memoryLimit int) *ipDefragmenter {
+	return &ipDefragmenter{
+		timeout:     timeout,
+		memoryLimit: memoryLimit,
+		datagrams:   make(map[fragmentKey]*fragmentedDatagram),
+	}
+}
+
+// add buffers fragment and returns reassembled payload with timestamp of the first fragment,
+// once every fragment of the datagram is received
+func (d *ipDefragmenter) add(f *ipFragment, timestamp time.Time) (payload []byte, start time.Time, complete bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.cleanup(timestamp)
+
+	// Nobody reads other protocols, don't waste memory on them
+	if f.key.protocol != layers.IPProtocolUDP {
+		return nil, start, false
+	}
+
+	dg, ok := d.datagrams[f.key]
+
+	if f.offset+len(f.data) > maxDatagramSize || d.memory+len(f.data) > d.memoryLimit {
+		d.dropped++
+		if ok {
+			d.discard(f.key, dg)
+		}
+		return nil, start, false
+	}
+
+	if !ok {
+		dg = &fragmentedDatagram{size: -1, start: timestamp}
+		d.datagrams[f.key] = dg
+	}
+
+	// Fragment data points to capture buffer, which is reused for next packets
+	data := make([]byte, len(f.data))
+	copy(data, f.data)
+
+	dg.fragments = append(dg.fragments, ipFragment{offset: f.offset, data: data})
+	dg.memory += len(data)
+	d.memory += len(data)
+
+	if !f.more {
+		dg.size = f.offset + len(data)
+	}
+
+	if payload, complete = dg.reassemble(); complete {
+		d.discard(f.key, dg)
+		d.reassembled++
+	}
+
+	return payload, dg.start, complete
+}
+
+// reassemble checks that fragments cover the whole datagram, overlapping fragments are allowed
+func (dg *fragmentedDatagram) reassemble() ([]byte, bool) {
+	if dg.size < 0 || dg.memory < dg.size {
+		return nil, false
+	}
+
+	sort.Slice(dg.fragments, func(i, j int) bool {
+		return dg.fragments[i].offset < dg.fragments[j].offset
+	})
+
+	payload := make([]byte, dg.size)
+	next := 0
+
+	for _, f := range dg.fragments {
+		if f.offset > next {
+			return nil, false
+		}
+
+		copy(payload[f.offset:], f.data)
+
+		if end := f.offset + len(f.data); end > next {
+			next = end
+		}
+	}
+
+	return payload, next >= dg.size
+}
+
+func (d *ipDefragmenter) discard(key fragmentKey, dg *fragmentedDatagram) {
+	d.memory -= dg.memory
+	delete(d.datagrams, key)
+}
+
+// expire runs cleanup when no fragments arrive, so incomplete datagrams don't hold memory after traffic stops.
+// Only for live capture, where capture timestamps follow the wall clock.
+func (d *ipDefragmenter) expire(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.cleanup(now)
+}
+
+// cleanup drops datagrams not completed in time and reports counters
+func (d *ipDefragmenter) cleanup(now time.Time) {
+	if now.Sub(d.lastCleanup) < time.Second {
+		return
+	}
+	d.lastCleanup = now
+
+	for key, dg := range d.datagrams {
+		if now.Sub(dg.start) > d.timeout {
+			d.discard(key, dg)
+			d.timedOut++
+		}
+	}
+
+	if now.Sub(d.lastReport) < defragReportInterval {
+		return
+	}
+	d.lastReport = now
+
+	// Keep quiet if nothing was fragmented since last report
+	if total := d.reassembled + d.timedOut + d.dropped; total != d.reported {
+		d.reported = total
+		log.Printf("IP defrag: reassembled %d, timed out %d, dropped %d, pending %d (%d bytes)\n",
+			d.reassembled, d.timedOut, d.dropped, len(d.datagrams), d.memory)
+	}
+}
@@ -0,0 +1,160 @@
+package listener
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var defragStart = time.Unix(1700000000, 0)
+
+// testUDPDatagram returns UDP header and 40 bytes of payload, split into fragments by tests
+func testUDPDatagram(t *testing.T) []byte {
+	t.Helper()
+
+	body := make([]byte, 40)
+	for i := range body {
+		body[i] = byte(48 + i)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, udp, gopacket.Payload(body)); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// testIPv4Fragment builds IPv4 packet holding data at offset of the datagram, received after delay
+func testIPv4Fragment(t *testing.T, protocol layers.IPProtocol, datagram []byte, from, to int, delay time.Duration) gopacket.Packet {
+	t.Helper()
+
+	ip := &layers.IPv4{
+		Version:    4,
+		TTL:        64,
+		Id:         7,
+		Protocol:   protocol,
+		FragOffset: uint16(from / 8),
+		SrcIP:      net.IP{10, 0, 0, 1},
+		DstIP:      net.IP{10, 0, 0, 53},
+	}
+	if to < len(datagram) {
+		ip.Flags = layers.IPv4MoreFragments
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, gopacket.Payload(datagram[from:to])); err != nil {
+		t.Fatal(err)
+	}
+
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	packet.Metadata().Timestamp = defragStart.Add(delay)
+
+	return packet
+}
+
+func TestIPv4Defrag(t *testing.T) {
+	datagram := testUDPDatagram(t)
+
+	tests := []struct {
+		name string
+		// Offsets of fragments in order of arrival
+		fragments [][2]int
+	}{
+		{"in order", [][2]int{{0, 16}, {16, 32}, {32, 48}}},
+		{"out of order", [][2]int{{32, 48}, {0, 16}, {16, 32}}},
+		{"last first", [][2]int{{32, 48}, {16, 32}, {0, 16}}},
+		{"overlap", [][2]int{{16, 40}, {0, 24}, {32, 48}}},
+		{"duplicate", [][2]int{{0, 16}, {0, 16}, {32, 48}, {16, 32}}},
+	}
+
+	for _, tt := range tests {
+		l := newTestListener(&CaptureConfig{})
+
+		for i, f := range tt.fragments {
+			l.handlePacket(testIPv4Fragment(t, layers.IPProtocolUDP, datagram, f[0], f[1], time.Duration(i)*time.Millisecond), "test0")
+		}
+
+		packets := queued(l)
+		if len(packets) != 1 {
+			t.Errorf("%s: expected 1 datagram, got %d", tt.name, len(packets))
+			continue
+		}
+		if !bytes.Equal(packets[0].payload, datagram) {
+			t.Errorf("%s: reassembled %q", tt.name, packets[0].payload)
+		}
+		// Timestamp of the first received fragment
+		if !packets[0].timestamp.Equal(defragStart) {
+			t.Errorf("%s: timestamp %v", tt.name, packets[0].timestamp)
+		}
+		if l.defrag.memory != 0 || len(l.defrag.datagrams) != 0 {
+			t.Errorf("%s: %d datagrams of %d bytes left", tt.name, len(l.defrag.datagrams), l.defrag.memory)
+		}
+	}
+}
+
+func TestIPv4DefragIncomplete(t *testing.T) {
+	datagram := testUDPDatagram(t)
+	l := newTestListener(&CaptureConfig{})
+
+	// Gap between 16 and 24
+	l.handlePacket(testIPv4Fragment(t, layers.IPProtocolUDP, datagram, 0, 16, 0), "test0")
+	l.handlePacket(testIPv4Fragment(t, layers.IPProtocolUDP, datagram, 24, 48, 0), "test0")
+
+	if packets := queued(l); len(packets) != 0 {
+		t.Errorf("datagram with gap reassembled")
+	}
+	if len(l.defrag.datagrams) != 1 {
+		t.Errorf("expected 1 pending datagram, got %d", len(l.defrag.datagrams))
+	}
+}
+
+func TestIPv4DefragExpiry(t *testing.T) {
+	datagram := testUDPDatagram(t)
+	l := newTestListener(&CaptureConfig{})
+	timeout := l.config.DefragTimeout
+
+	l.handlePacket(testIPv4Fragment(t, layers.IPProtocolUDP, datagram, 0, 16, 0), "test0")
+	l.handlePacket(testIPv4Fragment(t, layers.IPProtocolUDP, datagram, 16, 32, time.Second), "test0")
+
+	// The rest comes too late, previous fragments are dropped before it is added
+	l.handlePacket(testIPv4Fragment(t, layers.IPProtocolUDP, datagram, 32, 48, timeout+2*time.Second), "test0")
+
+	if packets := queued(l); len(packets) != 0 {
+		t.Errorf("datagram reassembled from expired fragments")
+	}
+	if l.defrag.timedOut != 1 || l.defrag.memory != 16 {
+		t.Errorf("timed out %d, %d bytes left", l.defrag.timedOut, l.defrag.memory)
+	}
+
+	// Without new fragments pending datagram is dropped by expire
+	l.defrag.expire(defragStart.Add(2*timeout + 4*time.Second))
+	if l.defrag.timedOut != 2 || l.defrag.memory != 0 || len(l.defrag.datagrams) != 0 {
+		t.Errorf("timed out %d, %d datagrams of %d bytes left", l.defrag.timedOut, len(l.defrag.datagrams), l.defrag.memory)
+	}
+}
+
+func TestIPv4DefragNotUDP(t *testing.T) {
+	datagram := testUDPDatagram(t)
+	l := newTestListener(&CaptureConfig{})
+
+	l.handlePacket(testIPv4Fragment(t, layers.IPProtocolTCP, datagram, 32, 48, 0), "test0")
+	l.handlePacket(testIPv4Fragment(t, layers.IPProtocolTCP, datagram, 0, 16, 0), "test0")
+	l.handlePacket(testIPv4Fragment(t, layers.IPProtocolTCP, datagram, 16, 32, 0), "test0")
+
+	if packets := queued(l); len(packets) != 0 {
+		t.Errorf("expected no datagrams, got %d", len(packets))
+	}
+
+	// Fragments of other protocols aren't buffered either
+	payload, _, complete := l.defrag.add(&ipFragment{key: fragmentKey{protocol: layers.IPProtocolTCP}, data: datagram}, defragStart)
+	if complete || payload != nil || len(l.defrag.datagrams) != 0 || l.defrag.memory != 0 {
+		t.Errorf("TCP fragment is buffered")
+	}
+}
@@ -2,22 +2,69 @@ package listener
 
 import (
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/myzhan/goreplay-udp/stats"
 	"io"
 	"log"
 	"net"
 	"runtime"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ipPacket owns pooled buffer its addresses and payload point to, ownership passes
+// to UDPMessage made of it, or buffer is released if packet is dropped
 type ipPacket struct {
+	buffer    *[]byte
 	srcIP     []byte
 	dstIP     []byte
 	payload   []byte
 	timestamp time.Time
+	// Capture interface, empty for pcap files
+	iface string
+	// IPv4 TTL and TOS, or IPv6 hop limit and traffic class
+	ttl uint8
+	tos uint8
+	// VLAN tags and tunnels packet was found in, see decapsulate
+	encap string
+}
+
+// Capture engines
+const (
+	CaptureEnginePcap     = "pcap"
+	CaptureEngineAFPacket = "af_packet"
+)
+
+// CaptureConfig holds options shared by live and offline capture
+type CaptureConfig struct {
+	TrackResponse bool
+	// Responses are paired with requests of the same flow sent no earlier than ResponseTimeout
+	ResponseTimeout time.Duration
+
+	// Incomplete fragmented datagrams are dropped after DefragTimeout or
+	// when buffered fragments exceed DefragMemoryLimit megabytes
+	DefragTimeout     time.Duration
+	DefragMemoryLimit int
+
+	// Capture engine, CaptureEnginePcap or CaptureEngineAFPacket with Fanout sockets per interface
+	Engine string
+	Fanout int
+
+	// Max number of VLAN tags and GRE, VXLAN or GENEVE tunnels to look through for inner packet, 0 disables it.
+	// Comma separated VLAN IDs and VNIs, packets outside of them are skipped. Empty list matches any packet.
+	DecapDepth int
+	VLAN       string
+	VNI        string
+
+	// Size and full queue policy of captured IP packets and of parsed UDP messages, see stats.QueueBlock
+	PacketQueueSize    int
+	PacketQueuePolicy  string
+	MessageQueueSize   int
+	MessageQueuePolicy string
 }
 
 type IPListener struct {
@@ -25,28 +72,73 @@ type IPListener struct {
 
 	// IP to listen
 	addr string
-	// Port to listen
-	port uint16
+	// Ports to listen, empty for any port
+	ports []PortRange
+
+	config *CaptureConfig
+	defrag *ipDefragmenter
 
-	trackResponse bool
+	// VLAN IDs and VNIs to decapsulate, nil for any
+	vlans map[uint32]bool
+	vnis  map[uint32]bool
 
 	pcapHandles []*pcap.Handle
+	// Set by Close, capture stops on the next packet
+	closed int32
 
 	ipPacketsChan chan *ipPacket
+	drops         *stats.Counter
 
 	readyChan chan bool
 }
 
-func NewIPListener(addr string, port uint16, trackResponse bool) (l *IPListener) {
+func NewIPListener(addr string, ports []PortRange, config *CaptureConfig) (l *IPListener) {
+	l = newIPListener(addr, ports, config)
+
+	go l.expireFragments()
+
+	switch config.Engine {
+	case CaptureEnginePcap, "":
+		go l.readPcap()
+	case CaptureEngineAFPacket:
+		go l.readAFPacket()
+	default:
+		log.Fatalf("Unknown capture engine %q, use %q or %q\n", config.Engine, CaptureEnginePcap, CaptureEngineAFPacket)
+	}
+
+	return
+}
+
+// NewIPFileListener reads packets from a pcap or pcapng file instead of a live interface
+func NewIPFileListener(path string, addr string, ports []PortRange, config *CaptureConfig) (l *IPListener) {
+	l = newIPListener(addr, ports, config)
+
+	go l.readPcapFile(path)
+
+	return
+}
+
+func newIPListener(addr string, ports []PortRange, config *CaptureConfig) (l *IPListener) {
 	l = &IPListener{}
-	l.ipPacketsChan = make(chan *ipPacket, 10000)
+	if err := stats.ValidateQueue("input-udp-packet-queue", config.PacketQueueSize, config.PacketQueuePolicy); err != nil {
+		log.Fatal(err)
+	}
+	l.ipPacketsChan = make(chan *ipPacket, config.PacketQueueSize)
+	l.drops = stats.NewDropCounter("input_udp_packet_queue " + addr)
 
 	l.readyChan = make(chan bool, 1)
 	l.addr = addr
-	l.port = port
-	l.trackResponse = trackResponse
+	l.ports = ports
+	l.config = config
+	l.defrag = newIPDefragmenter(config.DefragTimeout, config.DefragMemoryLimit*1024*1024)
 
-	go l.readPcap()
+	var err error
+	if l.vlans, err = ParseIDs(config.VLAN, 4095); err != nil {
+		log.Fatal("input-udp-vlan: ", err)
+	}
+	if l.vnis, err = ParseIDs(config.VNI, 1<<24-1); err != nil {
+		log.Fatal("input-udp-vni: ", err)
+	}
 
 	return
 }
@@ -64,7 +156,8 @@ func (e *DeviceNotFoundError) Error() string {
 	}
 
 	var msg string
-	msg += "Can't find interfaces with addr: " + e.addr + ". Provide available IP for intercepting traffic: \n"
+	msg += "Can't find interfaces with addr: " + e.addr + ". Provide available IP for intercepting traffic, " +
+		"or interface as zone to capture other host on mirror port, e.g. 10.1.2.3%eth1: \n"
 	for _, device := range devices {
 		msg += "Name: " + device.Name + "\n"
 		if device.Description != "" {
@@ -78,14 +171,36 @@ func (e *DeviceNotFoundError) Error() string {
 	return msg
 }
 
-func isLoopback(device pcap.Interface) bool {
-	if len(device.Addresses) == 0 {
+func hasAddress(device pcap.Interface, ip net.IP) bool {
+	for _, address := range device.Addresses {
+		if ip.Equal(address.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isRemoteHost checks that ip doesn't belong to any of capture devices
+func isRemoteHost(ip net.IP, devices []pcap.Interface) bool {
+	if ip == nil {
 		return false
 	}
 
-	switch device.Addresses[0].IP.String() {
-	case "127.0.0.1", "::1":
-		return true
+	for _, device := range devices {
+		if hasAddress(device, ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isLoopback(device pcap.Interface) bool {
+	for _, address := range device.Addresses {
+		if address.IP.IsLoopback() {
+			return true
+		}
 	}
 
 	return false
@@ -100,22 +215,58 @@ func listenAllInterfaces(addr string) bool {
 	}
 }
 
+// isGroupAddress checks for multicast or broadcast address, which doesn't belong to any interface
+func isGroupAddress(addr string) bool {
+	host, _ := splitZone(addr)
+	ip := net.ParseIP(host)
+
+	return ip != nil && (ip.IsMulticast() || ip.Equal(net.IPv4bcast))
+}
+
 func findPcapDevices(addr string) (interfaces []pcap.Interface, err error) {
 	devices, err := pcap.FindAllDevs()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Link-local IPv6 address is ambiguous without zone, e.g. fe80::1%eth0.
+	// For multicast groups zone limits capture to one interface, for other hosts' addresses it names the interface.
+	host, zone := splitZone(addr)
+	ip := net.ParseIP(host)
+	group := isGroupAddress(addr)
+
+	// Only the group 0 device is listed, others are opened by name
+	if isNFLogDevice(host) {
+		return []pcap.Interface{{Name: host}}, nil
+	}
+
 	for _, device := range devices {
-		if listenAllInterfaces(addr) && len(device.Addresses) > 0 || isLoopback(device) {
+		allInterfaces := listenAllInterfaces(addr) || group && (zone == "" || device.Name == zone)
+
+		if allInterfaces && len(device.Addresses) > 0 || isLoopback(device) {
 			interfaces = append(interfaces, device)
 			continue
 		}
 
-		for _, address := range device.Addresses {
-			if device.Name == addr || address.IP.String() == addr {
-				interfaces = append(interfaces, device)
-				return interfaces, nil
+		if zone != "" && device.Name != zone {
+			continue
+		}
+
+		// Devices without addresses, like `any`, are given by name
+		if device.Name == host {
+			return append(interfaces, device), nil
+		}
+
+		if ip != nil && hasAddress(device, ip) {
+			return append(interfaces, device), nil
+		}
+	}
+
+	// Address of other host on interface given as zone, e.g. mirror port of a switch
+	if ip != nil && zone != "" && !group {
+		for _, device := range devices {
+			if device.Name == zone {
+				return []pcap.Interface{device}, nil
 			}
 		}
 	}
@@ -127,12 +278,176 @@ func findPcapDevices(addr string) (interfaces []pcap.Interface, err error) {
 	return interfaces, nil
 }
 
-func (l *IPListener) buildPacket(srcIP []byte, dstIP []byte, payload []byte, timestamp time.Time) *ipPacket {
+// buildPacket copies packet data, it may point to capture buffer which is reused for the next packet
+func (l *IPListener) buildPacket(srcIP []byte, dstIP []byte, payload []byte, timestamp time.Time, iface string, ttl uint8, tos uint8) *ipPacket {
+	buf := proto.GetBuffer(len(srcIP) + len(dstIP) + len(payload))
+	data := *buf
+
+	n := copy(data, srcIP)
+	n += copy(data[n:], dstIP)
+	copy(data[n:], payload)
+
 	return &ipPacket{
-		srcIP:     srcIP,
-		dstIP:     dstIP,
-		payload:   payload,
+		buffer:    buf,
+		srcIP:     data[:len(srcIP)],
+		dstIP:     data[len(srcIP):n],
+		payload:   data[n:],
 		timestamp: timestamp,
+		iface:     iface,
+		ttl:       ttl,
+		tos:       tos,
+	}
+}
+
+func (p *ipPacket) release() {
+	proto.PutBuffer(p.buffer)
+	p.buffer = nil
+}
+
+// deviceHosts returns BPF host expressions of requests and responses captured on the device
+func (l *IPListener) deviceHosts(device pcap.Interface, devices []pcap.Interface) (bpfDstHost, bpfSrcHost string) {
+	if isGroupAddress(l.addr) {
+		// Datagrams are addressed to the group, responses come from members to the sender
+		host, _ := splitZone(l.addr)
+		return "dst host " + host, ""
+	}
+
+	// Traffic of other host mirrored to the device, see findPcapDevices
+	if host, _ := splitZone(l.addr); !listenAllInterfaces(l.addr) && isRemoteHost(net.ParseIP(host), devices) {
+		return "dst host " + host, "src host " + host
+	}
+
+	if isLoopback(device) {
+		var allAddr []string
+		for _, dc := range devices {
+			for _, addr := range dc.Addresses {
+				allAddr = append(allAddr, "(dst host "+addr.IP.String()+" and src host "+addr.IP.String()+")")
+			}
+		}
+
+		bpfDstHost = strings.Join(allAddr, " or ")
+		return bpfDstHost, bpfDstHost
+	}
+
+	for i, addr := range device.Addresses {
+		bpfDstHost += "dst host " + addr.IP.String()
+		bpfSrcHost += "src host " + addr.IP.String()
+		if i != len(device.Addresses)-1 {
+			bpfDstHost += " or "
+			bpfSrcHost += " or "
+		}
+	}
+
+	return bpfDstHost, bpfSrcHost
+}
+
+// bpfFilter builds BPF expression for requests to bpfDstHost and, if responses tracked, replies from bpfSrcHost.
+// Empty host expression matches any host.
+// Only the first fragment of a datagram has UDP header and IPv6 extension headers hide it from `udp` primitive,
+// so such packets between the hosts are captured without port check, and port is checked again after decoding.
+func (l *IPListener) bpfFilter(bpfDstHost, bpfSrcHost string) string {
+	dst := bpfPorts(l.ports, "dst")
+	if bpfDstHost != "" {
+		dst += " and (" + bpfDstHost + ")"
+	}
+
+	bpf := dst
+	hosts := bpfDstHost
+
+	if l.config.TrackResponse {
+		src := bpfPorts(l.ports, "src")
+		if bpfSrcHost != "" {
+			src += " and (" + bpfSrcHost + ")"
+			hosts = "(" + bpfDstHost + ") or (" + bpfSrcHost + ")"
+		} else {
+			hosts = ""
+		}
+
+		bpf = "(" + dst + ") or (" + src + ")"
+	}
+
+	// IPv4 with non-zero fragment offset, or IPv6 with extension headers
+	unparsed := "((ip[6:2] & 0x1fff != 0) or " + bpfIPv6Extensions + ")"
+	if hosts != "" {
+		unparsed += " and (" + hosts + ")"
+	}
+
+	filter := "(" + bpf + ") or (" + unparsed + ")"
+	if l.config.DecapDepth > 0 {
+		filter = bpfDecap(filter)
+	}
+
+	return filter
+}
+
+func (l *IPListener) handlePacket(packet gopacket.Packet, iface string) {
+	networkLayer, encap, ok := l.decapsulate(packet)
+	if networkLayer == nil || !ok {
+		return
+	}
+
+	srcIP := networkLayer.NetworkFlow().Src().Raw()
+	dstIP := networkLayer.NetworkFlow().Dst().Raw()
+	payload := networkLayer.LayerPayload()
+	timestamp := packet.Metadata().Timestamp
+
+	var fragment *ipFragment
+	var ttl, tos uint8
+
+	switch ip := networkLayer.(type) {
+	case *layers.IPv4:
+		// BPF passes other protocols inside tunnels, NFLOG has no BPF at all
+		if ip.Protocol != layers.IPProtocolUDP {
+			return
+		}
+		ttl, tos = ip.TTL, ip.TOS
+		fragment = ipv4Fragment(ip)
+	case *layers.IPv6:
+		ttl, tos = ip.HopLimit, ip.TrafficClass
+		var protocol layers.IPProtocol
+		protocol, payload = ipv6UpperLayer(ip)
+
+		switch protocol {
+		case layers.IPProtocolUDP:
+		case layers.IPProtocolIPv6Fragment:
+			// Extension headers after fragment header aren't walked
+			if fragment = ipv6Fragment(ip, payload); fragment == nil || fragment.key.protocol != layers.IPProtocolUDP {
+				return
+			}
+		default:
+			return
+		}
+	}
+
+	if fragment != nil {
+		var complete bool
+		payload, timestamp, complete = l.defrag.add(fragment, timestamp)
+		if !complete {
+			return
+		}
+	}
+
+	p := l.buildPacket(srcIP, dstIP, payload, timestamp, iface, ttl, tos)
+	p.encap = encap
+	l.queuePacket(p)
+}
+
+// ipv4Fragment returns nil if packet holds whole datagram
+func ipv4Fragment(ip *layers.IPv4) *ipFragment {
+	if ip.Flags&layers.IPv4MoreFragments == 0 && ip.FragOffset == 0 {
+		return nil
+	}
+
+	return &ipFragment{
+		key: fragmentKey{
+			src:      string(ip.SrcIP),
+			dst:      string(ip.DstIP),
+			id:       uint32(ip.Id),
+			protocol: ip.Protocol,
+		},
+		offset: int(ip.FragOffset) * 8,
+		more:   ip.Flags&layers.IPv4MoreFragments != 0,
+		data:   ip.Payload,
 	}
 }
 
@@ -179,42 +494,12 @@ func (l *IPListener) readPcap() {
 			l.mu.Lock()
 			l.pcapHandles = append(l.pcapHandles, handle)
 
-			var bpfDstHost, bpfSrcHost string
-			var loopback = isLoopback(device)
-
-			if loopback {
-				var allAddr []string
-				for _, dc := range devices {
-					for _, addr := range dc.Addresses {
-						allAddr = append(allAddr, "(dst host "+addr.IP.String()+" and src host "+addr.IP.String()+")")
-					}
-				}
-
-				bpfDstHost = strings.Join(allAddr, " or ")
-				bpfSrcHost = bpfDstHost
-			} else {
-				for i, addr := range device.Addresses {
-					bpfDstHost += "dst host " + addr.IP.String()
-					bpfSrcHost += "src host " + addr.IP.String()
-					if i != len(device.Addresses)-1 {
-						bpfDstHost += " or "
-						bpfSrcHost += " or "
-					}
-				}
-			}
-
-			if bpfSupported {
-
-				var bpf string
-
-				if l.trackResponse {
-					bpf = "(udp dst port " + strconv.Itoa(int(l.port)) + " and (" + bpfDstHost + ")) or (" + "udp src port " + strconv.Itoa(int(l.port)) + " and (" + bpfSrcHost + "))"
-				} else {
-					bpf = "udp dst port " + strconv.Itoa(int(l.port)) + " and (" + bpfDstHost + ")"
-				}
-
+			// NFLOG packets are selected by iptables rule, libpcap can't filter them
+			if bpfSupported && handle.LinkType() != linkTypeNFLog {
+				bpf := l.bpfFilter(l.deviceHosts(device, devices))
 				if err := handle.SetBPFFilter(bpf); err != nil {
 					log.Println("BPF filter error:", err, "Device:", device.Name, bpf)
+					l.mu.Unlock()
 					wg.Done()
 					return
 				}
@@ -224,7 +509,7 @@ func (l *IPListener) readPcap() {
 
 			l.mu.Unlock()
 
-			source := gopacket.NewPacketSource(handle, handle.LinkType())
+			source := gopacket.NewPacketSource(handle, linkDecoder(handle.LinkType()))
 			source.Lazy = true
 			source.NoCopy = true
 
@@ -232,20 +517,14 @@ func (l *IPListener) readPcap() {
 
 			for {
 				packet, err := source.NextPacket()
-				if err == io.EOF {
+				if err == io.EOF || atomic.LoadInt32(&l.closed) == 1 {
 					break
 				} else if err != nil {
 					log.Println("NextPacket error:", err)
 					continue
 				}
 
-				networkLayer := packet.NetworkLayer()
-
-				srcIP := networkLayer.NetworkFlow().Src().Raw()
-				dstIP := networkLayer.NetworkFlow().Dst().Raw()
-				payload := networkLayer.LayerPayload()
-
-				l.ipPacketsChan <- l.buildPacket(srcIP, dstIP, payload, packet.Metadata().Timestamp)
+				l.handlePacket(packet, device.Name)
 			}
 
 		}(d)
@@ -254,6 +533,84 @@ func (l *IPListener) readPcap() {
 	l.readyChan <- true
 }
 
+func (l *IPListener) readPcapFile(path string) {
+	handle, err := pcap.OpenOffline(path)
+	if err != nil {
+		log.Fatal("Can't open pcap file: ", path, " ", err)
+	}
+	defer handle.Close()
+
+	var bpfDstHost, bpfSrcHost string
+	if !listenAllInterfaces(l.addr) {
+		host, _ := splitZone(l.addr)
+		bpfDstHost = "dst host " + host
+		bpfSrcHost = "src host " + host
+	}
+
+	if handle.LinkType() != linkTypeNFLog {
+		bpf := l.bpfFilter(bpfDstHost, bpfSrcHost)
+		if err := handle.SetBPFFilter(bpf); err != nil {
+			log.Fatal("BPF filter error: ", err, " File: ", path, " ", bpf)
+		}
+	}
+
+	l.mu.Lock()
+	l.pcapHandles = append(l.pcapHandles, handle)
+	l.mu.Unlock()
+
+	l.readyChan <- true
+
+	// Packets are copied by buildPacket, so they can share the handle read buffer
+	source := gopacket.NewPacketSource(handle, linkDecoder(handle.LinkType()))
+	source.Lazy = true
+	source.NoCopy = true
+
+	for {
+		packet, err := source.NextPacket()
+		if err == io.EOF || atomic.LoadInt32(&l.closed) == 1 {
+			break
+		} else if err != nil {
+			// Unlike live capture, a broken file won't recover on next read
+			log.Println("NextPacket error:", err, "File:", path)
+			break
+		}
+
+		l.handlePacket(packet, "")
+	}
+
+	close(l.ipPacketsChan)
+}
+
+// queuePacket applies PacketQueuePolicy when Receiver channel is full
+func (l *IPListener) queuePacket(packet *ipPacket) {
+	switch l.config.PacketQueuePolicy {
+	case stats.QueueDropNewest:
+		select {
+		case l.ipPacketsChan <- packet:
+		default:
+			packet.release()
+			l.drops.Add(1)
+		}
+	case stats.QueueDropOldest:
+		for {
+			select {
+			case l.ipPacketsChan <- packet:
+				return
+			default:
+			}
+
+			select {
+			case dropped := <-l.ipPacketsChan:
+				dropped.release()
+				l.drops.Add(1)
+			default:
+			}
+		}
+	default:
+		l.ipPacketsChan <- packet
+	}
+}
+
 func (l *IPListener) IsReady() bool {
 	select {
 	case <-l.readyChan:
@@ -266,3 +623,23 @@ func (l *IPListener) IsReady() bool {
 func (l *IPListener) Receiver() chan *ipPacket {
 	return l.ipPacketsChan
 }
+
+// expireFragments drops timed out fragmented datagrams every second until capture stops
+func (l *IPListener) expireFragments() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if atomic.LoadInt32(&l.closed) == 1 {
+			return
+		}
+
+		l.defrag.expire(now)
+	}
+}
+
+// Close stops capture, already captured packets stay in Receiver channel
+func (l *IPListener) Close() error {
+	atomic.StoreInt32(&l.closed, 1)
+	return nil
+}
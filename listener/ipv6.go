@@ -0,0 +1,76 @@
+package listener
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket/layers"
+	"strings"
+)
+
+// BPF matches IPv6 packets which have extension headers before the upper layer,
+// libpcap `udp` primitive only checks the first next header field
+const bpfIPv6Extensions = "(ip6[6] = 0 or ip6[6] = 43 or ip6[6] = 44 or ip6[6] = 51 or ip6[6] = 60)"
+
+// splitZone splits link-local address like `fe80::1%eth0` into address and zone (interface name)
+func splitZone(addr string) (host string, zone string) {
+	if i := strings.LastIndexByte(addr, '%'); i != -1 {
+		return addr[:i], addr[i+1:]
+	}
+
+	return addr, ""
+}
+
+// ipv6UpperLayer walks IPv6 extension headers and returns upper-layer protocol with its payload.
+// Fragment header stops the walk, following headers are available after reassembly.
+func ipv6UpperLayer(ip *layers.IPv6) (layers.IPProtocol, []byte) {
+	next := ip.NextHeader
+	if ip.HopByHop != nil {
+		next = ip.HopByHop.NextHeader
+	}
+
+	data := ip.Payload
+
+	for {
+		if len(data) < 2 {
+			return next, data
+		}
+
+		var length int
+
+		switch next {
+		case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Destination:
+			length = (int(data[1]) + 1) * 8
+		case layers.IPProtocolAH:
+			length = (int(data[1]) + 2) * 4
+		default:
+			return next, data
+		}
+
+		// Truncated header
+		if len(data) < length {
+			return next, nil
+		}
+
+		next = layers.IPProtocol(data[0])
+		data = data[length:]
+	}
+}
+
+// ipv6Fragment decodes fragment header found by ipv6UpperLayer
+func ipv6Fragment(ip *layers.IPv6, data []byte) *ipFragment {
+	if len(data) < 8 {
+		return nil
+	}
+
+	return &ipFragment{
+		key: fragmentKey{
+			src:      string(ip.SrcIP),
+			dst:      string(ip.DstIP),
+			id:       binary.BigEndian.Uint32(data[4:8]),
+			protocol: layers.IPProtocol(data[0]),
+		},
+		// Offset is stored in 8-octet units in upper 13 bits
+		offset: int(binary.BigEndian.Uint16(data[2:4]) &^ 0x7),
+		more:   data[3]&0x1 != 0,
+		data:   data[8:],
+	}
+}
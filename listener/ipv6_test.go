@@ -0,0 +1,119 @@
+package listener
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+func TestIPv6ExtensionHeaders(t *testing.T) {
+	tests := []struct {
+		fixture string
+		src     string
+		payload string
+	}{
+		{"ipv6_hop_by_hop.pcap", "fe80::1", "hop-by-hop"},
+		{"ipv6_routing.pcap", "2001:db8::1", "routing"},
+		// Hop-by-hop, destination options, routing and destination options again
+		{"ipv6_destination.pcap", "2001:db8::1", "destination options chain"},
+	}
+
+	for _, tt := range tests {
+		packet, udp := captureOne(t, &CaptureConfig{}, tt.fixture)
+
+		if !net.IP(packet.srcIP).Equal(net.ParseIP(tt.src)) {
+			t.Errorf("%s: source %v, expected %s", tt.fixture, net.IP(packet.srcIP), tt.src)
+		}
+		if udp.SrcPort != 5353 || udp.DstPort != 53 {
+			t.Errorf("%s: ports %d -> %d", tt.fixture, udp.SrcPort, udp.DstPort)
+		}
+		if string(udp.Payload) != tt.payload {
+			t.Errorf("%s: payload %q, expected %q", tt.fixture, udp.Payload, tt.payload)
+		}
+		if packet.ttl != 64 {
+			t.Errorf("%s: hop limit %d", tt.fixture, packet.ttl)
+		}
+	}
+}
+
+func TestIPv6Fragments(t *testing.T) {
+	// Three fragments out of order, with destination options before fragment header
+	packet, udp := captureOne(t, &CaptureConfig{}, "ipv6_fragments.pcap")
+
+	expected := make([]byte, 40)
+	for i := range expected {
+		expected[i] = byte(48 + i)
+	}
+
+	if udp.DstPort != 53 || !bytes.Equal(udp.Payload, expected) {
+		t.Errorf("reassembled port %d, payload %q", udp.DstPort, udp.Payload)
+	}
+
+	// Timestamp of the first received fragment
+	if packet.timestamp.Unix() != 1700000000 {
+		t.Errorf("timestamp %v", packet.timestamp)
+	}
+}
+
+func TestIPv6UpperLayerTruncated(t *testing.T) {
+	// Hop-by-hop header claims 16 bytes, only 8 are captured
+	ip := &layers.IPv6{NextHeader: layers.IPProtocolIPv6HopByHop}
+	ip.Payload = []byte{17, 1, 0, 0, 0, 0, 0, 0}
+
+	protocol, payload := ipv6UpperLayer(ip)
+	if protocol != layers.IPProtocolIPv6HopByHop || payload != nil {
+		t.Errorf("got %v %v", protocol, payload)
+	}
+
+	if fragment := ipv6Fragment(ip, []byte{17, 0, 0}); fragment != nil {
+		t.Errorf("truncated fragment header decoded: %+v", fragment)
+	}
+}
+
+func TestSplitZone(t *testing.T) {
+	tests := []struct {
+		addr, host, zone string
+	}{
+		{"fe80::1%eth0", "fe80::1", "eth0"},
+		{"fe80::1", "fe80::1", ""},
+		{"239.1.1.1%eth1", "239.1.1.1", "eth1"},
+		{"10.0.0.1", "10.0.0.1", ""},
+		{"", "", ""},
+	}
+
+	for _, tt := range tests {
+		if host, zone := splitZone(tt.addr); host != tt.host || zone != tt.zone {
+			t.Errorf("splitZone(%q) = %q, %q", tt.addr, host, zone)
+		}
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	device := func(addrs ...string) pcap.Interface {
+		var d pcap.Interface
+		for _, a := range addrs {
+			d.Addresses = append(d.Addresses, pcap.InterfaceAddress{IP: net.ParseIP(a)})
+		}
+		return d
+	}
+
+	tests := []struct {
+		device   pcap.Interface
+		loopback bool
+	}{
+		{device("127.0.0.1", "::1"), true},
+		{device("::1"), true},
+		{device("10.0.0.1", "fe80::1", "127.0.0.2"), true},
+		{device("10.0.0.1", "fe80::1", "2001:db8::1"), false},
+		{device(), false},
+	}
+
+	for i, tt := range tests {
+		if isLoopback(tt.device) != tt.loopback {
+			t.Errorf("%d: expected loopback %v", i, tt.loopback)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package listener
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"strings"
+)
+
+// Link types gopacket doesn't decode
+const (
+	linkTypeNFLog = layers.LinkType(239)
+	// DLT_LINUX_SLL2 is 276, but pcap returns link type as uint8, so it is truncated to 20, which isn't assigned
+	linkTypeLinuxSLL2 = layers.LinkType(276 & 0xff)
+)
+
+const (
+	linuxSLL2HeaderLen = 20
+	nflogHeaderLen     = 4
+	// NFULA_PAYLOAD attribute holds the network layer packet, two high bits of type are netlink flags
+	nflogTypePayload = 9
+)
+
+var errNFLogNoPayload = errors.New("NFLOG packet without payload")
+
+// isNFLogDevice checks for iptables NFLOG group device: nflog or nflog:N
+func isNFLogDevice(name string) bool {
+	return name == "nflog" || strings.HasPrefix(name, "nflog:")
+}
+
+// linkDecoder returns decoder of packets captured with link type. Besides types decoded by gopacket,
+// `any` device on newer libpcap gives Linux SLL2, NFLOG groups give NFLOG, and raw IP files may be
+// written as IPv4 or IPv6 link types.
+func linkDecoder(linkType layers.LinkType) gopacket.Decoder {
+	switch linkType {
+	case linkTypeLinuxSLL2:
+		return gopacket.DecodeFunc(decodeLinuxSLL2)
+	case linkTypeNFLog:
+		return gopacket.DecodeFunc(decodeNFLog)
+	case layers.LinkTypeIPv4:
+		return layers.LayerTypeIPv4
+	case layers.LinkTypeIPv6:
+		return layers.LayerTypeIPv6
+	}
+
+	return linkType
+}
+
+// decodeLinuxSLL2 skips the header, its first field is EtherType of the payload
+func decodeLinuxSLL2(data []byte, p gopacket.PacketBuilder) error {
+	if len(data) < linuxSLL2HeaderLen {
+		return errors.New("Linux SLL2 packet too small")
+	}
+
+	return layers.EthernetType(binary.BigEndian.Uint16(data)).Decode(data[linuxSLL2HeaderLen:], p)
+}
+
+// decodeNFLog finds payload among TLV attributes following the header. Length and type of attributes
+// are in host byte order of the capturing machine, see nflogByteOrder.
+func decodeNFLog(data []byte, p gopacket.PacketBuilder) error {
+	if len(data) < nflogHeaderLen+4 {
+		return errNFLogNoPayload
+	}
+
+	order := nflogByteOrder(data[nflogHeaderLen:])
+
+	for tlv := data[nflogHeaderLen:]; len(tlv) >= 4; {
+		length := int(order.Uint16(tlv))
+		if length < 4 || length > len(tlv) {
+			break
+		}
+
+		if order.Uint16(tlv[2:])&0x3fff == nflogTypePayload {
+			payload := tlv[4:length]
+			if len(payload) == 0 {
+				break
+			}
+			if payload[0]>>4 == 6 {
+				return layers.LayerTypeIPv6.Decode(payload, p)
+			}
+			return layers.LayerTypeIPv4.Decode(payload, p)
+		}
+
+		// Attributes are padded to 4 bytes
+		if length = (length + 3) &^ 3; length > len(tlv) {
+			break
+		}
+		tlv = tlv[length:]
+	}
+
+	return errNFLogNoPayload
+}
+
+// nflogByteOrder detects byte order by type of the first attribute, types are below 256,
+// so the other byte order shifts it to the high byte
+func nflogByteOrder(tlv []byte) binary.ByteOrder {
+	if binary.LittleEndian.Uint16(tlv[2:])&0x3fff > 0xff {
+		return binary.BigEndian
+	}
+
+	return binary.LittleEndian
+}
@@ -0,0 +1,157 @@
+package listener
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestLinkTypes(t *testing.T) {
+	tests := []struct {
+		fixture string
+		src     string
+		payload string
+	}{
+		// `any` device of older and newer libpcap
+		{"any_sll.pcap", "10.0.0.1", "sll"},
+		{"any_sll2.pcap", "2001:db8::1", "sll2"},
+		// Raw IP of tun and wireguard interfaces, written with different link types
+		{"raw_dlt12.pcap", "10.0.0.1", "raw 12"},
+		{"raw_101.pcap", "2001:db8::1", "raw 101"},
+		{"ipv4.pcap", "10.0.0.1", "ipv4"},
+		{"ipv6.pcap", "2001:db8::1", "ipv6"},
+	}
+
+	for _, tt := range tests {
+		packet, udp := captureOne(t, &CaptureConfig{}, tt.fixture)
+
+		if !net.IP(packet.srcIP).Equal(net.ParseIP(tt.src)) {
+			t.Errorf("%s: source %v, expected %s", tt.fixture, net.IP(packet.srcIP), tt.src)
+		}
+		if udp.SrcPort != 5353 || udp.DstPort != 53 {
+			t.Errorf("%s: ports %d -> %d", tt.fixture, udp.SrcPort, udp.DstPort)
+		}
+		if string(udp.Payload) != tt.payload {
+			t.Errorf("%s: payload %q, expected %q", tt.fixture, udp.Payload, tt.payload)
+		}
+	}
+}
+
+func TestNFLogFixture(t *testing.T) {
+	// Payload follows hardware header and padded prefix attributes
+	packets := capture(t, newTestListener(&CaptureConfig{}), "nflog.pcap")
+	if len(packets) != 2 {
+		t.Fatalf("expected 2 packets, got %d", len(packets))
+	}
+
+	for i, src := range []string{"10.0.0.1", "2001:db8::1"} {
+		if !net.IP(packets[i].srcIP).Equal(net.ParseIP(src)) {
+			t.Errorf("packet %d: source %v, expected %s", i, net.IP(packets[i].srcIP), src)
+		}
+	}
+}
+
+func TestNFLogNotUDP(t *testing.T) {
+	// NFLOG has no BPF, so packets of other protocols logged by the same rule are skipped after decoding
+	if packets := capture(t, newTestListener(&CaptureConfig{}), "nflog_tcp.pcap"); len(packets) != 0 {
+		t.Errorf("expected TCP SYN to be skipped, got %d packets", len(packets))
+	}
+}
+
+// nflogAttr encodes TLV attribute, padded to 4 bytes
+func nflogAttr(order binary.ByteOrder, attrType uint16, value []byte) []byte {
+	attr := make([]byte, 4, 4+len(value)+3)
+	order.PutUint16(attr, uint16(4+len(value)))
+	order.PutUint16(attr[2:], attrType)
+	attr = append(attr, value...)
+
+	for len(attr)%4 != 0 {
+		attr = append(attr, 0)
+	}
+
+	return attr
+}
+
+func nflogPacket(attrs ...[]byte) []byte {
+	// AF_INET, version 0, group 5
+	data := []byte{2, 0, 0, 5}
+	for _, attr := range attrs {
+		data = append(data, attr...)
+	}
+
+	return data
+}
+
+func testDatagram(t *testing.T, payload string) []byte {
+	t.Helper()
+
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IP{10, 0, 0, 1},
+		DstIP:    net.IP{10, 0, 0, 53},
+	}
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestNFLogAttributes(t *testing.T) {
+	le, be := binary.LittleEndian, binary.BigEndian
+	datagram := testDatagram(t, "nflog")
+	// Prefix of 6 bytes is padded to 8
+	prefix := []byte("dns-q\x00")
+
+	full := nflogPacket(nflogAttr(le, 10, prefix), nflogAttr(le, nflogTypePayload, datagram))
+
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"padded prefix", full, true},
+		{"big endian", nflogPacket(nflogAttr(be, 10, prefix), nflogAttr(be, nflogTypePayload, datagram)), true},
+		{"netlink flags in type", nflogPacket(nflogAttr(le, 10|0x8000, prefix), nflogAttr(le, nflogTypePayload|0x4000, datagram)), true},
+		// Datagram of 33 bytes is padded by 3
+		{"unpadded last attribute", full[:len(full)-3], true},
+		{"payload missing", nflogPacket(nflogAttr(le, 10, prefix)), false},
+		{"payload truncated", full[:len(full)-4], false},
+		{"prefix truncated", full[:nflogHeaderLen+6], false},
+		{"padding truncated", full[:nflogHeaderLen+10], false},
+		{"length below attribute header", nflogPacket([]byte{2, 0, 10, 0}, nflogAttr(le, nflogTypePayload, datagram)), false},
+		{"empty payload", nflogPacket(nflogAttr(le, nflogTypePayload, nil)), false},
+		{"header only", nflogPacket(), false},
+	}
+
+	for _, tt := range tests {
+		packet := gopacket.NewPacket(tt.data, linkDecoder(linkTypeNFLog), gopacket.Default)
+
+		if !tt.ok {
+			if e := packet.ErrorLayer(); e == nil || e.Error() != errNFLogNoPayload {
+				t.Errorf("%s: expected %v, got %v", tt.name, errNFLogNoPayload, packet.Layers())
+			}
+			continue
+		}
+
+		udp, _ := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if udp == nil {
+			t.Errorf("%s: no UDP layer, error %v", tt.name, packet.ErrorLayer())
+			continue
+		}
+
+		if udp.DstPort != 53 || string(udp.Payload) != "nflog" {
+			t.Errorf("%s: port %d, payload %q", tt.name, udp.DstPort, udp.Payload)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package listener
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PortRange is an inclusive range of ports, single port has Min == Max
+type PortRange struct {
+	Min uint16
+	Max uint16
+}
+
+// ParsePorts parses ports given to --input-udp: `53`, `5060-5070`, `53,5060-5070` or `*` for any port.
+// Any port is returned as empty list.
+func ParsePorts(spec string) (ports []PortRange, err error) {
+	if spec == "*" {
+		return nil, nil
+	}
+
+	for _, item := range strings.Split(spec, ",") {
+		var r PortRange
+
+		bounds := strings.SplitN(item, "-", 2)
+		if r.Min, err = parsePort(bounds[0]); err != nil {
+			return nil, err
+		}
+
+		r.Max = r.Min
+		if len(bounds) == 2 {
+			if r.Max, err = parsePort(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+
+		if r.Min > r.Max {
+			return nil, fmt.Errorf("invalid port range %s", item)
+		}
+
+		ports = append(ports, r)
+	}
+
+	return ports, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+
+	return uint16(port), nil
+}
+
+func matchPorts(ports []PortRange, port uint16) bool {
+	if len(ports) == 0 {
+		return true
+	}
+
+	for _, r := range ports {
+		if port >= r.Min && port <= r.Max {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bpfPorts builds BPF expression matching UDP ports in given direction, `dst` or `src`
+func bpfPorts(ports []PortRange, direction string) string {
+	if len(ports) == 0 {
+		return "udp"
+	}
+
+	var exprs []string
+	for _, r := range ports {
+		if r.Min == r.Max {
+			exprs = append(exprs, "udp "+direction+" port "+strconv.Itoa(int(r.Min)))
+		} else {
+			exprs = append(exprs, "udp "+direction+" portrange "+strconv.Itoa(int(r.Min))+"-"+strconv.Itoa(int(r.Max)))
+		}
+	}
+
+	return "(" + strings.Join(exprs, " or ") + ")"
+}
@@ -0,0 +1,76 @@
+package listener
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		spec  string
+		ports []PortRange
+		ok    bool
+	}{
+		{"53", []PortRange{{53, 53}}, true},
+		{"5060-5070", []PortRange{{5060, 5070}}, true},
+		{"53, 5060-5070,67", []PortRange{{53, 53}, {5060, 5070}, {67, 67}}, true},
+		{"5060-5060", []PortRange{{5060, 5060}}, true},
+		{"1-65535", []PortRange{{1, 65535}}, true},
+		// Any port
+		{"*", nil, true},
+		{"", nil, false},
+		{"10-5", nil, false},
+		{"70000", nil, false},
+		{"0", nil, false},
+		{"53,", nil, false},
+		{"5060-", nil, false},
+		{"5060-5070-5080", nil, false},
+		{"dns", nil, false},
+		{"53,*", nil, false},
+	}
+
+	for _, tt := range tests {
+		ports, err := ParsePorts(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: unexpected error %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(ports, tt.ports) {
+			t.Errorf("%q: got %v, expected %v", tt.spec, ports, tt.ports)
+		}
+	}
+}
+
+func TestMatchPorts(t *testing.T) {
+	ports, _ := ParsePorts("53,5060-5070")
+
+	for port, matched := range map[uint16]bool{53: true, 54: false, 5059: false, 5060: true, 5065: true, 5070: true, 5071: false} {
+		if matchPorts(ports, port) != matched {
+			t.Errorf("port %d: expected match %v", port, matched)
+		}
+	}
+
+	if !matchPorts(nil, 1) {
+		t.Error("any port doesn't match")
+	}
+}
+
+func TestBPFPorts(t *testing.T) {
+	tests := []struct {
+		spec      string
+		direction string
+		expr      string
+	}{
+		{"*", "dst", "udp"},
+		{"53", "dst", "(udp dst port 53)"},
+		{"5060-5070", "src", "(udp src portrange 5060-5070)"},
+		{"53,5060-5070", "dst", "(udp dst port 53 or udp dst portrange 5060-5070)"},
+	}
+
+	for _, tt := range tests {
+		ports, _ := ParsePorts(tt.spec)
+		if expr := bpfPorts(ports, tt.direction); expr != tt.expr {
+			t.Errorf("%q %s: got %q, expected %q", tt.spec, tt.direction, expr, tt.expr)
+		}
+	}
+}
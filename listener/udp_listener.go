@@ -2,63 +2,234 @@ package listener
 
 import (
 	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/myzhan/goreplay-udp/stats"
 	"log"
-	"strconv"
+	"sync"
+	"time"
 )
 
+// Known server endpoints are forgotten after this time without traffic
+const serverEndpointTTL = time.Minute
+
 type UDPListener struct {
 	// IP to listen
 	addr string
-	// Port to listen
-	port uint16
+	// Ports to listen, empty for any port
+	ports []PortRange
+
+	config *CaptureConfig
+
+	// With any port, direction is guessed: the first seen datagram of a flow is a request,
+	// and its destination becomes a server endpoint
+	servers     map[string]time.Time
+	lastCleanup time.Time
+
+	// Pairs responses with requests, nil if responses are not tracked
+	tracker *requestTracker
 
 	messagesChan chan *proto.UDPMessage
+	drops        *stats.Counter
+	quit         chan bool
+	closeOnce    sync.Once
 
 	underlying *IPListener
 }
 
-func NewUDPListener(addr string, port string, trackResponse bool) (l *UDPListener) {
+func NewUDPListener(addr string, port string, config *CaptureConfig) (l *UDPListener) {
+	l = newUDPListener(addr, port, config)
+	l.underlying = NewIPListener(addr, l.ports, config)
+	l.start()
+
+	return
+}
+
+// NewUDPFileListener decodes UDP messages from a pcap or pcapng file, Receiver is closed at the end of file
+func NewUDPFileListener(path string, addr string, port string, config *CaptureConfig) (l *UDPListener) {
+	l = newUDPListener(addr, port, config)
+	l.underlying = NewIPFileListener(path, addr, l.ports, config)
+	l.start()
+
+	return
+}
+
+func newUDPListener(addr string, port string, config *CaptureConfig) (l *UDPListener) {
 	l = &UDPListener{}
-	l.messagesChan = make(chan *proto.UDPMessage, 10000)
+	if err := stats.ValidateQueue("input-udp-message-queue", config.MessageQueueSize, config.MessageQueuePolicy); err != nil {
+		log.Fatal(err)
+	}
+	l.messagesChan = make(chan *proto.UDPMessage, config.MessageQueueSize)
+	l.drops = stats.NewDropCounter("input_udp_message_queue " + addr)
+	l.quit = make(chan bool)
 	l.addr = addr
-	intPort, err := strconv.Atoi(port)
+	l.config = config
+	l.servers = make(map[string]time.Time)
+	if config.TrackResponse {
+		l.tracker = newRequestTracker(config.ResponseTimeout)
+	}
+	ports, err := ParsePorts(port)
 	if err != nil {
 		log.Fatalf("Invaild Port: %s, %v\n", port, err)
 	}
-	l.port = uint16(intPort)
+	l.ports = ports
 
-	l.underlying = NewIPListener(addr, l.port, trackResponse)
+	return
+}
 
+func (l *UDPListener) start() {
 	if l.underlying.IsReady() {
 		go l.recv()
 	} else {
 		log.Fatalln("IP Listener is not ready after 5 seconds")
 	}
-
-	return
 }
 
+// parseUDPPacket returns nil if packet doesn't belong to the listened ports,
+// BPF can't check ports of fragmented datagrams
 func (l *UDPListener) parseUDPPacket(packet *ipPacket) (message *proto.UDPMessage) {
 	data := packet.payload
 	message = proto.NewUDPMessage(data, false)
-	if message.DstPort == l.port {
+
+	switch {
+	case len(l.ports) == 0:
+		if !l.isResponse(packet, message) {
+			message.IsIncoming = true
+			message.ListenPort = message.DstPort
+		} else if l.config.TrackResponse {
+			message.ListenPort = message.SrcPort
+		} else {
+			return nil
+		}
+	case matchPorts(l.ports, message.DstPort):
 		message.IsIncoming = true
+		message.ListenPort = message.DstPort
+	case l.config.TrackResponse && matchPorts(l.ports, message.SrcPort):
+		message.ListenPort = message.SrcPort
+	default:
+		return nil
 	}
+
+	// Message takes packet buffer, its data and addresses point there
+	message.SetBuffer(packet.buffer)
+	packet.buffer = nil
+
 	message.Start = packet.timestamp
+	message.SrcIP = packet.srcIP
+	message.DstIP = packet.dstIP
+	message.Interface = packet.iface
+	message.TTL = packet.ttl
+	message.TOS = packet.tos
+	message.Encapsulation = packet.encap
 	return
 }
 
+// isResponse checks if message comes from known server endpoint, otherwise remembers its destination as one
+func (l *UDPListener) isResponse(packet *ipPacket, message *proto.UDPMessage) bool {
+	l.cleanupServers(packet.timestamp)
+
+	src := endpointKey(packet.srcIP, message.SrcPort)
+	if _, ok := l.servers[src]; ok {
+		l.servers[src] = packet.timestamp
+		return true
+	}
+
+	l.servers[endpointKey(packet.dstIP, message.DstPort)] = packet.timestamp
+
+	return false
+}
+
+func (l *UDPListener) cleanupServers(now time.Time) {
+	if now.Sub(l.lastCleanup) < serverEndpointTTL {
+		return
+	}
+	l.lastCleanup = now
+
+	for key, seen := range l.servers {
+		if now.Sub(seen) > serverEndpointTTL {
+			delete(l.servers, key)
+		}
+	}
+}
+
+func endpointKey(ip []byte, port uint16) string {
+	return string(ip) + ":" + string([]byte{byte(port >> 8), byte(port)})
+}
+
 func (l *UDPListener) recv() {
 	for {
 		ipPacketsChan := l.underlying.Receiver()
 		select {
-		case packet := <-ipPacketsChan:
-			message := l.parseUDPPacket(packet)
-			l.messagesChan <- message
+		case packet, ok := <-ipPacketsChan:
+			if !ok {
+				close(l.messagesChan)
+				return
+			}
+			l.handle(packet)
+		case <-l.quit:
+			// Packets captured before Close are still passed
+			for n := len(ipPacketsChan); n > 0; n-- {
+				if packet, ok := <-ipPacketsChan; ok {
+					l.handle(packet)
+				}
+			}
+			close(l.messagesChan)
+			return
 		}
 	}
 }
 
+func (l *UDPListener) handle(packet *ipPacket) {
+	message := l.parseUDPPacket(packet)
+	if message == nil {
+		packet.release()
+		return
+	}
+
+	if l.tracker != nil {
+		l.tracker.track(message)
+	}
+	l.queueMessage(message)
+}
+
+// queueMessage applies MessageQueuePolicy when Receiver channel is full
+func (l *UDPListener) queueMessage(message *proto.UDPMessage) {
+	switch l.config.MessageQueuePolicy {
+	case stats.QueueDropNewest:
+		select {
+		case l.messagesChan <- message:
+		default:
+			message.Release()
+			l.drops.Add(1)
+		}
+	case stats.QueueDropOldest:
+		for {
+			select {
+			case l.messagesChan <- message:
+				return
+			default:
+			}
+
+			select {
+			case dropped := <-l.messagesChan:
+				dropped.Release()
+				l.drops.Add(1)
+			default:
+			}
+		}
+	default:
+		l.messagesChan <- message
+	}
+}
+
+// Close stops capture, Receiver is closed after already captured messages
+func (l *UDPListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.underlying.Close()
+		close(l.quit)
+	})
+
+	return nil
+}
+
 func (l *UDPListener) Receiver() chan *proto.UDPMessage {
 	return l.messagesChan
 }
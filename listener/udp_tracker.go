@@ -0,0 +1,133 @@
+package listener
+
+import (
+	"github.com/myzhan/goreplay-udp/proto"
+	"log"
+	"net"
+	"time"
+)
+
+const trackerReportInterval = 5 * time.Second
+
+type pendingRequest struct {
+	uuid  []byte
+	start time.Time
+}
+
+// requestTracker pairs responses with requests of the same flow (client and server ip:port),
+// in order requests were sent. Capture timestamps are used as clock.
+type requestTracker struct {
+	timeout time.Duration
+
+	pending      map[string][]pendingRequest
+	pendingCount int
+
+	lastCleanup time.Time
+	lastReport  time.Time
+
+	paired             int
+	unmatchedRequests  int
+	unmatchedResponses int
+	reported           int
+}
+
+func newRequestTracker(timeout time.Duration) *requestTracker {
+	return &requestTracker{
+		timeout: timeout,
+		pending: make(map[string][]pendingRequest),
+	}
+}
+
+func flowKey(clientIP []byte, clientPort uint16, serverIP []byte, serverPort uint16) string {
+	return endpointKey(clientIP, clientPort) + endpointKey(serverIP, serverPort)
+}
+
+// groupServerIP hides multicast and broadcast destination, members answer from their own addresses
+func groupServerIP(ip net.IP) net.IP {
+	if ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+		return nil
+	}
+
+	return ip
+}
+
+// track remembers requests and pairs responses with them
+func (t *requestTracker) track(m *proto.UDPMessage) {
+	t.cleanup(m.Start)
+
+	if m.IsIncoming {
+		key := flowKey(m.SrcIP, m.SrcPort, groupServerIP(m.DstIP), m.DstPort)
+		t.pending[key] = append(t.pending[key], pendingRequest{uuid: m.UUID(), start: m.Start})
+		t.pendingCount++
+		return
+	}
+
+	key := flowKey(m.DstIP, m.DstPort, m.SrcIP, m.SrcPort)
+	requests, ok := t.pending[key]
+	if !ok {
+		key = flowKey(m.DstIP, m.DstPort, nil, m.SrcPort)
+		requests = t.pending[key]
+	}
+
+	// Requests which waited too long can't be answered by this response
+	for len(requests) > 0 && m.Start.Sub(requests[0].start) > t.timeout {
+		requests = requests[1:]
+		t.pendingCount--
+		t.unmatchedRequests++
+	}
+
+	if len(requests) == 0 {
+		delete(t.pending, key)
+		t.unmatchedResponses++
+		return
+	}
+
+	m.PairWith(requests[0].uuid, requests[0].start)
+	t.paired++
+	t.pendingCount--
+
+	if len(requests) == 1 {
+		delete(t.pending, key)
+	} else {
+		t.pending[key] = requests[1:]
+	}
+}
+
+// cleanup expires requests without response and reports counters
+func (t *requestTracker) cleanup(now time.Time) {
+	if now.Sub(t.lastCleanup) < time.Second {
+		return
+	}
+	t.lastCleanup = now
+
+	for key, requests := range t.pending {
+		expired := 0
+		for expired < len(requests) && now.Sub(requests[expired].start) > t.timeout {
+			expired++
+		}
+
+		if expired == 0 {
+			continue
+		}
+
+		t.pendingCount -= expired
+		t.unmatchedRequests += expired
+
+		if expired == len(requests) {
+			delete(t.pending, key)
+		} else {
+			t.pending[key] = requests[expired:]
+		}
+	}
+
+	if now.Sub(t.lastReport) < trackerReportInterval {
+		return
+	}
+	t.lastReport = now
+
+	if total := t.paired + t.unmatchedRequests + t.unmatchedResponses; total != t.reported {
+		t.reported = total
+		log.Printf("Response tracking: paired %d, unmatched requests %d, unmatched responses %d, pending %d\n",
+			t.paired, t.unmatchedRequests, t.unmatchedResponses, t.pendingCount)
+	}
+}
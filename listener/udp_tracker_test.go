@@ -0,0 +1,140 @@
+package listener
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/myzhan/goreplay-udp/proto"
+)
+
+var trackerStart = time.Unix(1700000000, 0)
+
+type trackedMessage struct {
+	// Name of request, or of request the response is expected to pair with, empty if it shouldn't pair
+	name string
+	at   time.Duration
+	src  string
+	dst  string
+	// Response, otherwise request
+	response bool
+}
+
+func trackerMessage(t *testing.T, m trackedMessage) *proto.UDPMessage {
+	t.Helper()
+
+	src, err := net.ResolveUDPAddr("udp", m.src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := net.ResolveUDPAddr("udp", m.dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &proto.UDPMessage{
+		IsIncoming: !m.response,
+		Start:      trackerStart.Add(m.at),
+		SrcIP:      src.IP,
+		SrcPort:    uint16(src.Port),
+		DstIP:      dst.IP,
+		DstPort:    uint16(dst.Port),
+	}
+}
+
+func TestRequestTracker(t *testing.T) {
+	const (
+		client  = "10.0.0.1:5353"
+		client2 = "10.0.0.2:5353"
+		server  = "10.0.0.53:53"
+	)
+
+	tests := []struct {
+		name     string
+		messages []trackedMessage
+		// Requests expired or evicted without response, and responses without request
+		unmatchedRequests, unmatchedResponses int
+	}{
+		{"in order", []trackedMessage{
+			{"a", 0, client, server, false},
+			{"b", 10 * time.Millisecond, client, server, false},
+			{"a", 20 * time.Millisecond, server, client, true},
+			{"b", 30 * time.Millisecond, server, client, true},
+		}, 0, 0},
+		{"flows", []trackedMessage{
+			{"a", 0, client, server, false},
+			{"b", 10 * time.Millisecond, client2, server, false},
+			{"b", 20 * time.Millisecond, server, client2, true},
+			{"a", 30 * time.Millisecond, server, client, true},
+		}, 0, 0},
+		{"response without request", []trackedMessage{
+			{"a", 0, client, server, false},
+			{"", 10 * time.Millisecond, server, client2, true},
+			// Other server port is other flow
+			{"", 20 * time.Millisecond, "10.0.0.53:54", client, true},
+			{"a", 30 * time.Millisecond, server, client, true},
+			{"", 40 * time.Millisecond, server, client, true},
+		}, 0, 3},
+		{"timeout", []trackedMessage{
+			{"x", 0, client2, server, false},
+			{"a", 50 * time.Millisecond, client, server, false},
+			// Periodic cleanup runs, request a hasn't expired yet
+			{"b", time.Second, client, server, false},
+			// Request a waited longer than timeout, it is skipped before next cleanup
+			{"b", 1500 * time.Millisecond, server, client, true},
+		}, 1, 0},
+		{"expired", []trackedMessage{
+			{"a", 0, client, server, false},
+			{"b", 1500 * time.Millisecond, client, server, false},
+			{"b", 1800 * time.Millisecond, server, client, true},
+		}, 1, 0},
+		{"eviction", []trackedMessage{
+			{"a", 0, client, server, false},
+			// Message of any flow expires requests of the others
+			{"b", 5 * time.Second, client2, server, false},
+			{"", 5*time.Second + 10*time.Millisecond, server, client, true},
+		}, 1, 1},
+		{"multicast", []trackedMessage{
+			{"a", 0, client, "239.1.1.1:53", false},
+			// Member answers from its own address
+			{"a", 10 * time.Millisecond, "10.0.0.7:53", client, true},
+		}, 0, 0},
+	}
+
+	for _, tt := range tests {
+		tracker := newRequestTracker(time.Second)
+		requests := make(map[string]*proto.UDPMessage)
+
+		for i, m := range tt.messages {
+			msg := trackerMessage(t, m)
+			tracker.track(msg)
+
+			if !m.response {
+				requests[m.name] = msg
+				continue
+			}
+
+			label := tt.name + " " + strconv.Itoa(i)
+			if m.name == "" {
+				if msg.Latency != 0 {
+					t.Errorf("%s: unmatched response has latency %v", label, msg.Latency)
+				}
+				continue
+			}
+
+			request := requests[m.name]
+			if !bytes.Equal(msg.UUID(), request.UUID()) {
+				t.Errorf("%s: response isn't paired with %s", label, m.name)
+			}
+			if latency := msg.Start.Sub(request.Start); msg.Latency != latency {
+				t.Errorf("%s: latency %v, expected %v", label, msg.Latency, latency)
+			}
+		}
+
+		if tracker.unmatchedRequests != tt.unmatchedRequests || tracker.unmatchedResponses != tt.unmatchedResponses {
+			t.Errorf("%s: unmatched requests %d, responses %d", tt.name, tracker.unmatchedRequests, tracker.unmatchedResponses)
+		}
+	}
+}
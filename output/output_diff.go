@@ -0,0 +1,300 @@
+package output
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/myzhan/goreplay-udp/proto"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Decoders for DiffOutput
+const (
+	DiffDecoderBytes = "bytes"
+	DiffDecoderDNS   = "dns"
+)
+
+const diffReportInterval = 5 * time.Second
+
+type DiffOutputConfig struct {
+	// Comma separated inclusive byte ranges which are not compared, e.g. `0-1,8-15`, open range `20-` lasts till the end
+	Ignore  string
+	Decoder string
+	// Response without its pair after Timeout is reported as unpaired
+	Timeout time.Duration
+}
+
+type byteRange struct {
+	from int
+	to   int
+}
+
+type diffPair struct {
+	original []byte
+	replayed []byte
+	seen     time.Time
+}
+
+// DiffOutput pairs original responses with replayed responses by request ID and reports differences.
+// Summary goes to log every 5 seconds, full diffs to the file.
+type DiffOutput struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+	closed bool
+
+	ignore []byteRange
+	pairs  map[string]*diffPair
+
+	compared   int
+	mismatched int
+	unpaired   int
+
+	config *DiffOutputConfig
+}
+
+// NewDiffOutput constructor for DiffOutput, accepts path of diff file
+func NewDiffOutput(path string, config *DiffOutputConfig) *DiffOutput {
+	o := new(DiffOutput)
+	o.path = path
+	o.config = config
+	o.pairs = make(map[string]*diffPair)
+
+	var err error
+	if o.ignore, err = parseByteRanges(config.Ignore); err != nil {
+		log.Fatal("output-diff: ", err)
+	}
+
+	if config.Decoder != DiffDecoderBytes && config.Decoder != DiffDecoderDNS {
+		log.Fatalf("Unknown diff decoder %q, use %q or %q\n", config.Decoder, DiffDecoderBytes, DiffDecoderDNS)
+	}
+
+	if o.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660); err != nil {
+		log.Fatalf("Cannot open file %q. Error: %s", path, err)
+	}
+	o.writer = bufio.NewWriter(o.file)
+
+	go o.reportStats()
+
+	return o
+}
+
+func parseByteRanges(s string) (ranges []byteRange, err error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	for _, item := range strings.Split(s, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(item), "-", 2)
+
+		r := byteRange{to: -1}
+		if r.from, err = strconv.Atoi(bounds[0]); err != nil || r.from < 0 {
+			return nil, fmt.Errorf("invalid byte range %q", item)
+		}
+
+		switch {
+		case len(bounds) == 1:
+			r.to = r.from
+		case bounds[1] != "":
+			if r.to, err = strconv.Atoi(bounds[1]); err != nil || r.to < r.from {
+				return nil, fmt.Errorf("invalid byte range %q", item)
+			}
+		}
+
+		ranges = append(ranges, r)
+	}
+
+	return ranges, nil
+}
+
+func (o *DiffOutput) Write(data []byte) (n int, err error) {
+	if data[0] != proto.ResponsePayload && data[0] != proto.ReplayedResponsePayload {
+		return len(data), nil
+	}
+
+	meta := proto.PayloadMeta(data)
+	if len(meta) < 2 {
+		return len(data), nil
+	}
+
+	body := proto.PayloadBody(data)
+	buf := make([]byte, len(body))
+	copy(buf, body)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	id := string(meta[1])
+	pair, ok := o.pairs[id]
+	if !ok {
+		pair = &diffPair{seen: time.Now()}
+		o.pairs[id] = pair
+	}
+
+	if data[0] == proto.ResponsePayload {
+		pair.original = buf
+	} else {
+		pair.replayed = buf
+	}
+
+	if pair.original != nil && pair.replayed != nil {
+		delete(o.pairs, id)
+		o.compare(id, pair)
+	}
+
+	return len(data), nil
+}
+
+func (o *DiffOutput) compare(id string, pair *diffPair) {
+	o.compared++
+
+	var original, replayed, summary string
+	if o.config.Decoder == DiffDecoderDNS {
+		original, replayed = decodeDNS(pair.original), decodeDNS(pair.replayed)
+		if original == replayed {
+			return
+		}
+		summary = "decoded responses differ"
+	} else if ranges := o.diffRanges(pair.original, pair.replayed); ranges != nil {
+		original, replayed = hex.Dump(pair.original), hex.Dump(pair.replayed)
+		summary = "differs at bytes " + strings.Join(ranges, ",")
+	} else {
+		return
+	}
+
+	o.mismatched++
+
+	fmt.Fprintf(o.writer, "%s %s\n--- original (%d bytes)\n%s+++ replayed (%d bytes)\n%s\n",
+		id, summary, len(pair.original), original, len(pair.replayed), replayed)
+}
+
+// diffRanges returns differing byte ranges outside of ignored ones, or nil if responses are equal
+func (o *DiffOutput) diffRanges(original, replayed []byte) []string {
+	var ranges []string
+
+	size := len(original)
+	if len(replayed) > size {
+		size = len(replayed)
+	}
+
+	start := -1
+	for i := 0; i <= size; i++ {
+		differs := i < size && !o.ignored(i) &&
+			(i >= len(original) || i >= len(replayed) || original[i] != replayed[i])
+
+		if differs && start == -1 {
+			start = i
+		} else if !differs && start != -1 {
+			ranges = append(ranges, strconv.Itoa(start)+"-"+strconv.Itoa(i-1))
+			start = -1
+		}
+	}
+
+	return ranges
+}
+
+func (o *DiffOutput) ignored(offset int) bool {
+	for _, r := range o.ignore {
+		if offset >= r.from && (r.to == -1 || offset <= r.to) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// decodeDNS describes DNS message without volatile fields: transaction ID and TTLs.
+// Records are sorted, because servers may rotate them.
+func decodeDNS(data []byte) string {
+	dns := &layers.DNS{}
+	if err := dns.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		return "undecodable DNS message: " + err.Error() + "\n" + hex.Dump(data)
+	}
+
+	var lines []string
+	for _, q := range dns.Questions {
+		lines = append(lines, fmt.Sprintf("question %s %s %s", q.Name, q.Type, q.Class))
+	}
+
+	sections := map[string][]layers.DNSResourceRecord{
+		"answer":     dns.Answers,
+		"authority":  dns.Authorities,
+		"additional": dns.Additionals,
+	}
+	for section, records := range sections {
+		for _, rr := range records {
+			lines = append(lines, fmt.Sprintf("%s %s %s %s", section, rr.Name, rr.Type, rr.String()))
+		}
+	}
+	sort.Strings(lines)
+
+	header := fmt.Sprintf("opcode %s rcode %s aa=%v tc=%v rd=%v ra=%v\n",
+		dns.OpCode, dns.ResponseCode, dns.AA, dns.TC, dns.RD, dns.RA)
+
+	return header + strings.Join(lines, "\n") + "\n"
+}
+
+// expire reports responses which didn't get a pair in time
+func (o *DiffOutput) expire() {
+	for id, pair := range o.pairs {
+		if time.Since(pair.seen) < o.config.Timeout {
+			continue
+		}
+
+		delete(o.pairs, id)
+		o.unpaired++
+
+		if pair.original != nil {
+			fmt.Fprintf(o.writer, "%s has no replayed response\n", id)
+		} else {
+			fmt.Fprintf(o.writer, "%s has no original response\n", id)
+		}
+	}
+}
+
+func (o *DiffOutput) reportStats() {
+	for {
+		time.Sleep(diffReportInterval)
+
+		o.mu.Lock()
+		if o.closed {
+			o.mu.Unlock()
+			return
+		}
+
+		o.expire()
+		o.writer.Flush()
+		log.Printf("output_diff:compared %d, mismatched %d, unpaired %d, pending %d\n",
+			o.compared, o.mismatched, o.unpaired, len(o.pairs))
+		o.mu.Unlock()
+	}
+}
+
+func (o *DiffOutput) String() string {
+	return "Diff output: " + o.path
+}
+
+func (o *DiffOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+
+	log.Printf("output_diff:compared %d, mismatched %d, unpaired %d, pending %d\n",
+		o.compared, o.mismatched, o.unpaired, len(o.pairs))
+
+	o.writer.Flush()
+	return o.file.Close()
+}
@@ -0,0 +1,104 @@
+package output
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/myzhan/goreplay-udp/proto"
+)
+
+func TestParseByteRanges(t *testing.T) {
+	tests := []struct {
+		spec   string
+		ranges []byteRange
+		ok     bool
+	}{
+		{"", nil, true},
+		{"0-1,8-15", []byteRange{{0, 1}, {8, 15}}, true},
+		{" 3 , 5-5", []byteRange{{3, 3}, {5, 5}}, true},
+		// Open range lasts till the end
+		{"20-", []byteRange{{20, -1}}, true},
+		{"5-3", nil, false},
+		{"-1", nil, false},
+		{"a", nil, false},
+		{"1-b", nil, false},
+		{"1,,2", nil, false},
+	}
+
+	for _, tt := range tests {
+		ranges, err := parseByteRanges(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: unexpected error %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(ranges, tt.ranges) {
+			t.Errorf("%q: got %v, expected %v", tt.spec, ranges, tt.ranges)
+		}
+	}
+}
+
+func TestDiffRanges(t *testing.T) {
+	tests := []struct {
+		original string
+		replayed string
+		ignore   string
+		ranges   string
+	}{
+		{"abcdef", "abcdef", "", ""},
+		{"abcdef", "aXcdef", "", "1-1"},
+		{"abcdef", "XXcdeX", "", "0-1,5-5"},
+		{"abcdef", "abXXXf", "", "2-4"},
+		// Missing bytes differ
+		{"abc", "abcdef", "", "3-5"},
+		{"abcdef", "ab", "", "2-5"},
+		{"", "ab", "", "0-1"},
+		// Ignored bytes split or hide differences
+		{"abcdef", "aXcdef", "1", ""},
+		{"abcdef", "XXXXXf", "2", "0-1,3-4"},
+		{"abcdef", "XXcdXX", "0-1,4-5", ""},
+		{"abc", "abcdef", "4-", "3-3"},
+		// Transaction ID of DNS, the usual use
+		{"\x12\x34\x81\x80", "\xab\xcd\x81\x83", "0-1", "3-3"},
+	}
+
+	for _, tt := range tests {
+		o := &DiffOutput{}
+		o.ignore, _ = parseByteRanges(tt.ignore)
+
+		if ranges := strings.Join(o.diffRanges([]byte(tt.original), []byte(tt.replayed)), ","); ranges != tt.ranges {
+			t.Errorf("%q vs %q, ignore %q: got %q, expected %q", tt.original, tt.replayed, tt.ignore, ranges, tt.ranges)
+		}
+	}
+}
+
+func TestDiffOutputWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "diff.log")
+	o := NewDiffOutput(path, &DiffOutputConfig{Ignore: "0", Decoder: DiffDecoderBytes})
+
+	response := func(payloadType byte, id string, body string) []byte {
+		return append(proto.PayloadHeader(payloadType, []byte(id), 1, 53), body...)
+	}
+
+	// Requests aren't compared, pairs are found by ID in any order
+	o.Write(response(proto.RequestPayload, "1", "abc"))
+	o.Write(response(proto.ReplayedResponsePayload, "1", "Xbc"))
+	o.Write(response(proto.ResponsePayload, "2", "abc"))
+	o.Write(response(proto.ResponsePayload, "1", "abc"))
+	o.Write(response(proto.ReplayedResponsePayload, "2", "aXc"))
+	o.Close()
+
+	if o.compared != 2 || o.mismatched != 1 || len(o.pairs) != 0 {
+		t.Errorf("compared %d, mismatched %d, pending %d", o.compared, o.mismatched, len(o.pairs))
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "2 differs at bytes 1-1\n") || strings.Contains(string(data), "\n1 ") {
+		t.Errorf("unexpected diff:\n%s", data)
+	}
+}
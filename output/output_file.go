@@ -29,11 +29,18 @@ var dateFileNameFuncs = map[string]func(*FileOutput) string{
 	"%t":  func(o *FileOutput) string { return string(o.payloadType) },
 }
 
+// File formats, see proto.WriteRecord
+const (
+	FileFormatRecords = "records"
+	FileFormatLegacy  = "legacy"
+)
+
 type FileOutputConfig struct {
 	FlushInterval time.Duration
 	SizeLimit     unitSizeVar
 	QueueLimit    int
 	Append        bool
+	Format        string
 }
 
 // FileOutput output plugin
@@ -60,6 +67,10 @@ func NewFileOutput(pathTemplate string, config *FileOutputConfig) *FileOutput {
 	o.config = config
 	o.updateName()
 
+	if config.Format != FileFormatRecords && config.Format != FileFormatLegacy {
+		log.Fatalf("Unknown output file format %q, use %q or %q\n", config.Format, FileFormatRecords, FileFormatLegacy)
+	}
+
 	if strings.Contains(pathTemplate, "%r") {
 		o.requestPerFile = true
 	}
@@ -208,12 +219,20 @@ func (o *FileOutput) Write(data []byte) (n int, err error) {
 			log.Fatal(o, "Cannot open file %q. Error: %s", o.currentName, err)
 		}
 
+		if o.config.Format == FileFormatRecords {
+			proto.WriteFileHeader(o.writer)
+		}
+
 		o.queueLength = 0
 		o.mu.Unlock()
 	}
 
-	o.writer.Write(data)
-	o.writer.Write([]byte(proto.PayloadSeparator))
+	if o.config.Format == FileFormatRecords {
+		proto.WriteRecord(o.writer, data)
+	} else {
+		o.writer.Write(data)
+		o.writer.Write([]byte(proto.PayloadSeparator))
+	}
 
 	o.queueLength++
 
@@ -244,8 +263,9 @@ func (o *FileOutput) flush() {
 	}
 }
 
+// String uses path template, file isn't open before the first write
 func (o *FileOutput) String() string {
-	return "File output: " + o.file.Name()
+	return "File output: " + o.pathTemplate
 }
 
 func (o *FileOutput) Close() error {
@@ -0,0 +1,253 @@
+package output
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/myzhan/goreplay-udp/stats"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var errPacketTooBig = errors.New("packet exceeds MTU")
+
+type RawUDPOutputConfig struct {
+	// Source subnet rewrites like `10.1.0.0/16=192.168.0.0/16`, host bits of the address are kept
+	Rewrite []string
+}
+
+type subnetRewrite struct {
+	from *net.IPNet
+	to   *net.IPNet
+}
+
+// RawUDPOutput replays requests from their captured client ip:port, building IP and UDP headers itself.
+// Requires root or CAP_NET_RAW, and replies go to the original clients, so use it in isolated networks only.
+type RawUDPOutput struct {
+	// Requests accepted by Write and not sent yet, first for 64bit alignment
+	pending int64
+
+	address string
+	target  *net.UDPAddr
+	queue   chan []byte
+
+	socket   *rawSocket
+	rewrites []subnetRewrite
+	// Requests larger than MTU of outgoing interface, they are not fragmented
+	tooBig *stats.Counter
+
+	config *RawUDPOutputConfig
+}
+
+// NewRawUDPOutput constructor for RawUDPOutput, accepts target address
+func NewRawUDPOutput(address string, config *RawUDPOutputConfig) (o *RawUDPOutput) {
+	o = new(RawUDPOutput)
+	o.address = address
+	o.config = config
+	o.queue = make(chan []byte, 10000)
+
+	var err error
+	if o.target, err = net.ResolveUDPAddr("udp", address); err != nil {
+		log.Fatalf("Error initialize raw UDP output %s, %v\n", address, err)
+	}
+
+	if o.rewrites, err = parseSubnetRewrites(config.Rewrite); err != nil {
+		log.Fatal("output-udp-raw: ", err)
+	}
+
+	o.tooBig = stats.NewDropCounter("output_udp_raw_too_big " + address)
+
+	if o.socket, err = newRawSocket(o.target.IP.To4() == nil); err != nil {
+		log.Fatal("output-udp-raw: can't open raw socket, ensure that you running as root user or sudo: ", err)
+	}
+
+	go o.worker()
+
+	return o
+}
+
+func parseSubnetRewrites(rules []string) (rewrites []subnetRewrite, err error) {
+	for _, rule := range rules {
+		subnets := strings.SplitN(rule, "=", 2)
+		if len(subnets) != 2 {
+			return nil, fmt.Errorf("invalid rewrite %q, expected from=to", rule)
+		}
+
+		var r subnetRewrite
+		if _, r.from, err = net.ParseCIDR(subnets[0]); err != nil {
+			return nil, err
+		}
+		if _, r.to, err = net.ParseCIDR(subnets[1]); err != nil {
+			return nil, err
+		}
+
+		fromOnes, fromBits := r.from.Mask.Size()
+		toOnes, toBits := r.to.Mask.Size()
+		if fromOnes != toOnes || fromBits != toBits {
+			return nil, fmt.Errorf("invalid rewrite %q, subnets should have the same size", rule)
+		}
+
+		rewrites = append(rewrites, r)
+	}
+
+	return rewrites, nil
+}
+
+// rewriteSource maps address into the first matching rewrite subnet
+func (o *RawUDPOutput) rewriteSource(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	for _, r := range o.rewrites {
+		if !r.from.Contains(ip) {
+			continue
+		}
+
+		rewritten := make(net.IP, len(r.to.IP))
+		for i := range rewritten {
+			rewritten[i] = r.to.IP[i] | ip[i]&^r.to.Mask[i]
+		}
+
+		return rewritten
+	}
+
+	return ip
+}
+
+func (o *RawUDPOutput) Write(data []byte) (n int, err error) {
+	if !proto.IsRequestPayload(data) {
+		return len(data), nil
+	}
+
+	buf := make([]byte, len(data))
+	copy(buf, data)
+
+	atomic.AddInt64(&o.pending, 1)
+	o.queue <- buf
+
+	return len(data), nil
+}
+
+func (o *RawUDPOutput) worker() {
+	serializeBuf := gopacket.NewSerializeBuffer()
+
+	for request := range o.queue {
+		o.send(serializeBuf, request)
+		atomic.AddInt64(&o.pending, -1)
+	}
+}
+
+func (o *RawUDPOutput) send(serializeBuf gopacket.SerializeBuffer, request []byte) {
+	client := proto.PayloadMetaValue(request, proto.MetaClient)
+	if client == nil {
+		log.Println("Raw UDP output: request has no captured client address, skipping")
+		return
+	}
+
+	src, err := net.ResolveUDPAddr("udp", string(client))
+	if err != nil {
+		log.Println("Raw UDP output: invalid client address", string(client), err)
+		return
+	}
+	src.IP = o.rewriteSource(src.IP)
+
+	packet, err := o.buildPacket(serializeBuf, src, request)
+	if err != nil {
+		log.Println("Raw UDP output:", err)
+		return
+	}
+
+	if err := o.socket.send(o.target.IP, packet); err == errPacketTooBig {
+		o.tooBig.Add(1)
+	} else if err != nil {
+		log.Printf("Raw UDP Write Error: %v\n", err)
+	}
+}
+
+// buildPacket serializes IP and UDP headers with checksums, captured TTL and TOS are kept
+func (o *RawUDPOutput) buildPacket(buf gopacket.SerializeBuffer, src *net.UDPAddr, request []byte) ([]byte, error) {
+	ttl := uint8(64)
+	if value := proto.PayloadMetaValue(request, proto.MetaTTL); value != nil {
+		if v, err := strconv.ParseUint(string(value), 10, 8); err == nil && v > 0 {
+			ttl = uint8(v)
+		}
+	}
+
+	var tos uint8
+	if value := proto.PayloadMetaValue(request, proto.MetaTOS); value != nil {
+		if v, err := strconv.ParseUint(string(value), 10, 8); err == nil {
+			tos = uint8(v)
+		}
+	}
+
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(src.Port),
+		DstPort: layers.UDPPort(o.target.Port),
+	}
+
+	var ip gopacket.SerializableLayer
+
+	srcIsV4, dstIsV4 := src.IP.To4() != nil, o.target.IP.To4() != nil
+	switch {
+	case srcIsV4 && dstIsV4:
+		ip4 := &layers.IPv4{
+			Version:  4,
+			TTL:      ttl,
+			TOS:      tos,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    src.IP.To4(),
+			DstIP:    o.target.IP.To4(),
+		}
+		udp.SetNetworkLayerForChecksum(ip4)
+		ip = ip4
+	case !srcIsV4 && !dstIsV4:
+		ip6 := &layers.IPv6{
+			Version:      6,
+			HopLimit:     ttl,
+			TrafficClass: tos,
+			NextHeader:   layers.IPProtocolUDP,
+			SrcIP:        src.IP.To16(),
+			DstIP:        o.target.IP.To16(),
+		}
+		udp.SetNetworkLayerForChecksum(ip6)
+		ip = ip6
+	default:
+		return nil, fmt.Errorf("can't send from %s to %s, address families differ", src.IP, o.target.IP)
+	}
+
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload(proto.PayloadBody(request))); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (o *RawUDPOutput) String() string {
+	return "Raw UDP output: " + o.address
+}
+
+// Drain waits until queued requests are sent, or deadline passes
+func (o *RawUDPOutput) Drain(deadline time.Time) bool {
+	for atomic.LoadInt64(&o.pending) > 0 {
+		if time.Now().After(deadline) {
+			log.Printf("Raw UDP output %s: %d requests are not sent before drain deadline\n", o.address, atomic.LoadInt64(&o.pending))
+			return false
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return true
+}
+
+func (o *RawUDPOutput) Close() error {
+	return o.socket.Close()
+}
@@ -4,6 +4,12 @@ import (
 	"github.com/myzhan/goreplay-udp/client"
 	"github.com/myzhan/goreplay-udp/proto"
 	"github.com/myzhan/goreplay-udp/stats"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -15,6 +21,43 @@ type UDPOutputConfig struct {
 	Timeout        time.Duration
 	Stats          bool
 	IgnoreResponse bool
+	TrackResponses bool
+
+	// Size and full queue policy of requests waiting for workers, see stats.QueueBlock
+	QueueSize   int
+	QueuePolicy string
+
+	// Replay each captured client ip:port from its own socket, closed after SessionTimeout of inactivity
+	SessionAffinity bool
+	SessionTimeout  time.Duration
+	MaxSessions     int
+
+	// Space sends by captured timestamps, waiting or lagging no more than MaxDelay
+	Timing   bool
+	MaxDelay time.Duration
+
+	// Requests wait for workers in directory, queue of each output is capped by SpillMaxSize megabytes
+	SpillDir     string
+	SpillMaxSize int
+
+	// Send up to BatchSize queued requests with one syscall, responses must be ignored
+	BatchSize int
+
+	// Hostname of the target is resolved again after this interval, 0 resolves it once
+	ResolveInterval time.Duration
+
+	// Options of multicast targets
+	MulticastTTL       int
+	MulticastLoopback  bool
+	MulticastInterface string
+}
+
+type response struct {
+	payload   []byte
+	uuid      []byte
+	port      uint16
+	startedAt int64
+	latency   time.Duration
 }
 
 type UDPOutPut struct {
@@ -22,26 +65,119 @@ type UDPOutPut struct {
 	// alignment. atomic.* functions crash on 32bit machines if operand is not
 	// aligned at 64bit. See https://github.com/golang/go/issues/599
 	activeWorkers int64
+	// Requests accepted by Write and not sent yet
+	pending int64
 
 	needWorker chan int
 
-	address string
-	queue   chan []byte
+	address   string
+	queue     chan []byte
+	scheduled chan []byte
+	responses chan *response
+	// Closed by Drain, Read returns EOF when no responses left
+	drained chan struct{}
+
+	// Address like `staging.com:*` sends each request to the port it was captured on
+	host     string
+	keepPort bool
+
+	spill *spillQueue
+
+	sessionsMu sync.Mutex
+	sessions   map[string]*udpSession
 
-	config     *UDPOutputConfig
-	queueStats *stats.GorStat
+	config       *UDPOutputConfig
+	clientConfig *client.UDPClientConfig
+	queueStats   *stats.GorStat
+	sessionStats *stats.GorStat
+	lagStats     *stats.GorStat
+	drops        *stats.Counter
+	unavailable  *stats.Counter
+	latencyStats *stats.LatencyStat
 }
 
 func NewUDPOutput(address string, config *UDPOutputConfig) (o *UDPOutPut) {
 	o = new(UDPOutPut)
 	o.address = address
 	o.config = config
+	o.clientConfig = &client.UDPClientConfig{
+		Timeout:            config.Timeout,
+		IgnoreResponse:     config.IgnoreResponse,
+		ResolveInterval:    config.ResolveInterval,
+		MulticastTTL:       config.MulticastTTL,
+		MulticastLoopback:  config.MulticastLoopback,
+		MulticastInterface: config.MulticastInterface,
+	}
+
+	if host, port, err := net.SplitHostPort(address); err == nil && port == "*" {
+		o.host = host
+		o.keepPort = true
+	}
+
+	if err := stats.ValidateQueue("output-udp-queue", config.QueueSize, config.QueuePolicy); err != nil {
+		log.Fatal(err)
+	}
+	o.drops = stats.NewDropCounter("output_udp_queue " + address)
+	o.unavailable = stats.NewDropCounter("output_udp_target_unavailable " + address)
 
 	if o.config.Stats {
 		o.queueStats = stats.NewGorStat("output_udp")
+
+		if o.config.SessionAffinity {
+			o.sessionStats = stats.NewGorStat("output_udp_sessions")
+		}
+
+		if !o.config.IgnoreResponse {
+			o.latencyStats = stats.NewLatencyStat("output_udp_latency " + address)
+		}
+	}
+
+	o.responses = make(chan *response, 10000)
+	o.drained = make(chan struct{})
+
+	if o.config.Timing {
+		if o.config.Stats {
+			o.lagStats = stats.NewGorStat("output_udp_lag_us")
+		}
+
+		o.scheduled = make(chan []byte, o.config.QueueSize)
+		go o.schedule()
+	}
+
+	o.startWorkers()
+
+	// Spilled requests may be left by previous run, so workers should be ready
+	if o.config.SpillDir != "" {
+		var err error
+		if o.spill, err = newSpillQueue(filepath.Join(o.config.SpillDir, spillDirName(address)), int64(o.config.SpillMaxSize)*1024*1024); err != nil {
+			log.Fatal("output-udp-spill-dir: ", err)
+		}
+
+		go o.unspill()
+		go o.reportSpill()
+	}
+
+	return o
+}
+
+func (o *UDPOutPut) startWorkers() {
+	// Sessions replace the worker pool
+	if o.config.SessionAffinity {
+		o.sessions = make(map[string]*udpSession)
+		return
+	}
+
+	o.queue = make(chan []byte, o.config.QueueSize)
+
+	if o.config.BatchSize > 0 {
+		if !o.config.IgnoreResponse {
+			log.Fatal("--output-udp-batch requires --output-udp-ignore-response")
+		}
+
+		o.startBatchWorkers()
+		return
 	}
 
-	o.queue = make(chan []byte, 10000)
 	o.needWorker = make(chan int, 1)
 
 	// Initial workers count
@@ -52,7 +188,6 @@ func NewUDPOutput(address string, config *UDPOutputConfig) (o *UDPOutPut) {
 	}
 
 	go o.workerMaster()
-	return o
 }
 
 func (o *UDPOutPut) workerMaster() {
@@ -70,13 +205,23 @@ func (o *UDPOutPut) workerMaster() {
 }
 
 func (o *UDPOutPut) startWorker() {
-	c := client.NewUDPClient(o.address, o.config.Timeout, o.config.IgnoreResponse)
+	clients := make(map[uint16]*client.UDPClient)
+	// Idle worker of dynamic pool exits, its sockets aren't used by other workers
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+
 	deathCount := 0
 	atomic.AddInt64(&o.activeWorkers, 1)
 	for {
 		select {
 		case data := <-o.queue:
-			o.sendRequest(c, data)
+			if c := o.client(clients, data); c != nil {
+				o.sendRequest(c, data)
+			}
+			o.done(data)
 			deathCount = 0
 		case <-time.After(time.Millisecond * 100):
 			// When dynamic scaling enabled workers die after 2s of inactivity
@@ -104,31 +249,218 @@ func (o *UDPOutPut) Write(data []byte) (n int, err error) {
 		return len(data), nil
 	}
 
+	if o.spill != nil {
+		if err := o.spill.push(data); err != nil {
+			log.Println("UDP output: can't spill request to disk:", err)
+		}
+		return len(data), nil
+	}
+
 	buf := make([]byte, len(data))
 	copy(buf, data)
 
-	o.queue <- buf
+	o.enqueue(buf)
+
+	return len(data), nil
+}
+
+func (o *UDPOutPut) enqueue(buf []byte) {
+	atomic.AddInt64(&o.pending, 1)
+
+	if o.config.Timing {
+		o.push(o.scheduled, buf)
+	} else {
+		o.dispatch(buf)
+	}
+}
+
+// dispatch passes request to workers or client session
+func (o *UDPOutPut) dispatch(buf []byte) {
+	if o.config.SessionAffinity {
+		o.writeSession(buf)
+		return
+	}
+
+	o.push(o.queue, buf)
 
 	if o.config.Stats {
 		o.queueStats.Write(len(o.queue))
 	}
 
-	if o.config.Workers == 0 {
+	if o.config.Workers == 0 && o.config.BatchSize == 0 {
 		workersCount := atomic.LoadInt64(&o.activeWorkers)
 
 		if len(o.queue) > int(workersCount) {
 			o.needWorker <- len(o.queue)
 		}
 	}
+}
 
-	return len(data), nil
+// push applies QueuePolicy when queue is full, dropped requests are not pending anymore
+func (o *UDPOutPut) push(queue chan []byte, request []byte) {
+	switch o.config.QueuePolicy {
+	case stats.QueueDropNewest:
+		select {
+		case queue <- request:
+		default:
+			o.drop(request)
+		}
+	case stats.QueueDropOldest:
+		for {
+			select {
+			case queue <- request:
+				return
+			default:
+			}
+
+			select {
+			case old := <-queue:
+				o.drop(old)
+			default:
+			}
+		}
+	default:
+		queue <- request
+	}
 }
 
-func (o *UDPOutPut) sendRequest(client *client.UDPClient, request []byte) {
+func (o *UDPOutPut) drop(request []byte) {
+	o.drops.Add(1)
+	o.done(request)
+}
+
+// done is called once request is sent or dropped, spilled request is not read again after restart
+func (o *UDPOutPut) done(request []byte) {
+	if o.spill != nil {
+		o.spill.done(request)
+	}
+	atomic.AddInt64(&o.pending, -1)
+}
+
+// unsent returns requests accepted and not sent yet, including ones read from spill queue and not enqueued yet
+func (o *UDPOutPut) unsent() int64 {
+	n := atomic.LoadInt64(&o.pending)
+	if o.spill != nil && n == 0 {
+		n = int64(o.spill.unsentCount())
+	}
+
+	return n
+}
+
+// client returns worker's client for the request, one per target port
+func (o *UDPOutPut) client(clients map[uint16]*client.UDPClient, request []byte) *client.UDPClient {
+	var port uint16
+	if o.keepPort {
+		if port = proto.PayloadListenPort(request); port == 0 {
+			log.Println("UDP output: request has no captured port, skipping:", o.address)
+			return nil
+		}
+	}
+
+	c, ok := clients[port]
+	if !ok {
+		address := o.address
+		if o.keepPort {
+			address = net.JoinHostPort(o.host, strconv.Itoa(int(port)))
+		}
+
+		c = client.NewUDPClient(address, o.clientConfig)
+		clients[port] = c
+	}
+
+	return c
+}
+
+// Read returns replayed responses, if --output-udp-track-response is set
+func (o *UDPOutPut) Read(data []byte) (int, error) {
+	var resp *response
+
+	select {
+	case resp = <-o.responses:
+	case <-o.drained:
+		select {
+		case resp = <-o.responses:
+		default:
+			return 0, io.EOF
+		}
+	}
+
+	header := proto.PayloadExtendedHeader(proto.ReplayedResponsePayload, resp.uuid, resp.startedAt, resp.port,
+		proto.MetaLatency, strconv.FormatInt(resp.latency.Nanoseconds(), 10))
+
+	n := copy(data, header)
+	n += copy(data[n:], resp.payload)
+
+	return n, nil
+}
+
+// EmitsResponses tells if Read returns anything, so nobody waits for responses which aren't tracked
+func (o *UDPOutPut) EmitsResponses() bool {
+	return o.config.TrackResponses
+}
+
+func (o *UDPOutPut) sendRequest(c *client.UDPClient, request []byte) {
 	body := proto.PayloadBody(request)
-	client.Send(body)
+
+	start := time.Now()
+	resp, err := c.Send(body)
+	stop := time.Now()
+
+	if client.IsUnavailable(err) {
+		o.unavailable.Add(1)
+		return
+	}
+
+	if o.latencyStats != nil {
+		o.latencyStats.Write(stop.Sub(start), err)
+	}
+
+	if !o.config.TrackResponses || err != nil || resp == nil {
+		return
+	}
+
+	o.responses <- &response{
+		payload:   resp,
+		uuid:      proto.PayloadMeta(request)[1],
+		port:      proto.PayloadListenPort(request),
+		startedAt: start.UnixNano(),
+		latency:   stop.Sub(start),
+	}
 }
 
 func (o *UDPOutPut) String() string {
 	return "UDP output: " + o.address
 }
+
+// Drain waits until queued requests are sent and their responses are received, or deadline passes
+func (o *UDPOutPut) Drain(deadline time.Time) bool {
+	defer close(o.drained)
+
+	// Spilled requests not read yet, or not sent before deadline, are read again by the next run
+	if o.spill != nil {
+		o.spill.Close()
+	}
+
+	for o.unsent() > 0 {
+		if time.Now().After(deadline) {
+			log.Printf("UDP output %s: %d requests are not sent before drain deadline\n", o.address, o.unsent())
+			return false
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return true
+}
+
+func (o *UDPOutPut) Close() error {
+	if o.spill != nil {
+		o.spill.Close()
+	}
+
+	if o.latencyStats != nil {
+		return o.latencyStats.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package output
+
+import (
+	"github.com/myzhan/goreplay-udp/client"
+	"github.com/myzhan/goreplay-udp/proto"
+)
+
+// startBatchWorkers starts fixed pool of workers, one batch worker keeps up with far more requests than one per-request worker
+func (o *UDPOutPut) startBatchWorkers() {
+	workers := o.config.Workers
+	if workers == 0 {
+		workers = 1
+	}
+
+	for i := 0; i < workers; i++ {
+		go o.startBatchWorker()
+	}
+}
+
+// startBatchWorker waits for a request, then takes what is already queued, up to BatchSize
+func (o *UDPOutPut) startBatchWorker() {
+	clients := make(map[uint16]*client.UDPClient)
+	batch := make([][]byte, 0, o.config.BatchSize)
+
+	for {
+		batch = append(batch[:0], <-o.queue)
+
+	drain:
+		for len(batch) < o.config.BatchSize {
+			select {
+			case data := <-o.queue:
+				batch = append(batch, data)
+			default:
+				break drain
+			}
+		}
+
+		o.sendBatch(clients, batch)
+		for _, request := range batch {
+			o.done(request)
+		}
+	}
+}
+
+// sendBatch sends runs of requests going to the same target port together
+func (o *UDPOutPut) sendBatch(clients map[uint16]*client.UDPClient, batch [][]byte) {
+	bodies := make([][]byte, 0, len(batch))
+
+	var current *client.UDPClient
+	for _, request := range batch {
+		c := o.client(clients, request)
+		if c == nil {
+			continue
+		}
+
+		if c != current && len(bodies) > 0 {
+			o.sendBodies(current, bodies)
+			bodies = bodies[:0]
+		}
+
+		current = c
+		bodies = append(bodies, proto.PayloadBody(request))
+	}
+
+	if len(bodies) > 0 {
+		o.sendBodies(current, bodies)
+	}
+}
+
+func (o *UDPOutPut) sendBodies(c *client.UDPClient, bodies [][]byte) {
+	if _, err := c.SendBatch(bodies); client.IsUnavailable(err) {
+		o.unavailable.Add(len(bodies))
+	}
+}
@@ -0,0 +1,59 @@
+package output
+
+import (
+	"github.com/myzhan/goreplay-udp/proto"
+	"strconv"
+	"time"
+)
+
+// schedule sends requests with the same intervals they were captured with.
+// Captured time is mapped to wall clock by the first request, and mapping is reset
+// when a request would wait or lag more than MaxDelay, e.g. after a pause in traffic.
+func (o *UDPOutPut) schedule() {
+	var capturedBase int64
+	var wallBase time.Time
+
+	for request := range o.scheduled {
+		meta := proto.PayloadMeta(request)
+		if len(meta) < 3 {
+			o.dispatch(request)
+			continue
+		}
+
+		captured, err := strconv.ParseInt(string(meta[2]), 10, 64)
+		if err != nil {
+			o.dispatch(request)
+			continue
+		}
+
+		now := time.Now()
+		if wallBase.IsZero() {
+			capturedBase, wallBase = captured, now
+		}
+
+		due := wallBase.Add(time.Duration(captured - capturedBase))
+		delay := due.Sub(now)
+
+		var lag time.Duration
+
+		switch {
+		case delay > o.config.MaxDelay:
+			capturedBase, wallBase = captured, now
+		case delay > 0:
+			time.Sleep(delay)
+			lag = time.Since(due)
+		default:
+			lag = -delay
+			if lag > o.config.MaxDelay {
+				capturedBase, wallBase = captured, now
+			}
+		}
+
+		if o.config.Stats {
+			// Scheduling lag in microseconds
+			o.lagStats.Write(int(lag / time.Microsecond))
+		}
+
+		o.dispatch(request)
+	}
+}
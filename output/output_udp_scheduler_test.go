@@ -0,0 +1,87 @@
+package output
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/myzhan/goreplay-udp/stats"
+)
+
+func TestUDPOutputTiming(t *testing.T) {
+	const ms = time.Millisecond
+
+	type request struct {
+		// Captured time from the first request
+		captured time.Duration
+		// Pause of input before the request is written
+		pause time.Duration
+		// Expected interval after the previous request is received
+		min, max time.Duration
+	}
+
+	tests := []struct {
+		name     string
+		requests []request
+	}{
+		{"captured intervals", []request{
+			{0, 0, 0, 0},
+			{50 * ms, 0, 40 * ms, 90 * ms},
+			{120 * ms, 0, 60 * ms, 110 * ms},
+		}},
+		// Pause in captured traffic longer than MaxDelay isn't waited
+		{"wait clamp", []request{
+			{0, 0, 0, 0},
+			{10 * time.Second, 0, 0, 30 * ms},
+			{10*time.Second + 50*ms, 0, 40 * ms, 90 * ms},
+		}},
+		// Input lagged more than MaxDelay, later requests keep intervals from the late one instead of catching up
+		{"lag clamp", []request{
+			{0, 0, 0, 0},
+			{50 * ms, 300 * ms, 290 * ms, 340 * ms},
+			{100 * ms, 0, 40 * ms, 90 * ms},
+		}},
+		// Lag within MaxDelay is caught up, the next request is due 20ms later
+		{"small lag", []request{
+			{0, 0, 0, 0},
+			{50 * ms, 80 * ms, 70 * ms, 120 * ms},
+			{100 * ms, 0, 0, 45 * ms},
+		}},
+	}
+
+	for _, tt := range tests {
+		s := newTestServer(t)
+		o := NewUDPOutput(s.conn.LocalAddr().String(), &UDPOutputConfig{
+			Workers:        1,
+			Timeout:        time.Second,
+			IgnoreResponse: true,
+			QueueSize:      10,
+			QueuePolicy:    stats.QueueBlock,
+			Timing:         true,
+			MaxDelay:       100 * ms,
+		})
+
+		start := time.Unix(1700000000, 0)
+		var last time.Time
+
+		for i, r := range tt.requests {
+			time.Sleep(r.pause)
+
+			body := strconv.Itoa(i)
+			o.Write(append(proto.PayloadHeader(proto.RequestPayload, []byte("f45590522cd1838b4a0d5c5aab80b77929dea3b3"), start.Add(r.captured).UnixNano(), 53), body...))
+			s.receive(t, body)
+
+			received := time.Now()
+			if i > 0 {
+				if interval := received.Sub(last); interval < r.min || interval > r.max {
+					t.Errorf("%s: request %d is received after %v, expected %v-%v", tt.name, i, interval, r.min, r.max)
+				}
+			}
+			last = received
+		}
+
+		o.Close()
+		s.conn.Close()
+	}
+}
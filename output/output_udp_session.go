@@ -0,0 +1,108 @@
+package output
+
+import (
+	"github.com/myzhan/goreplay-udp/client"
+	"github.com/myzhan/goreplay-udp/proto"
+	"time"
+)
+
+// udpSession replays requests of one captured client ip:port from its own sockets, in capture order.
+// Fields besides queue are guarded by sessionsMu.
+type udpSession struct {
+	key      string
+	queue    chan []byte
+	lastUsed time.Time
+
+	// Requests being pushed to queue, session doesn't expire and its queue isn't closed meanwhile
+	writers int
+	// Evicted while in use, the last writer closes queue
+	evicted bool
+}
+
+// writeSession queues request to the session of its client flow, creating one if needed.
+// Least recently used session is closed when MaxSessions is reached.
+func (o *UDPOutPut) writeSession(request []byte) {
+	key := string(proto.PayloadMetaValue(request, proto.MetaClient))
+
+	o.sessionsMu.Lock()
+	s, ok := o.sessions[key]
+	if !ok {
+		if o.config.MaxSessions > 0 && len(o.sessions) >= o.config.MaxSessions {
+			o.evictSession()
+		}
+
+		s = &udpSession{key: key, queue: make(chan []byte, o.config.QueueSize)}
+		o.sessions[key] = s
+
+		go o.runSession(s)
+	}
+
+	s.lastUsed = time.Now()
+	s.writers++
+
+	if o.config.Stats {
+		o.sessionStats.Write(len(o.sessions))
+	}
+	o.sessionsMu.Unlock()
+
+	// Full queue of one session doesn't block the others
+	o.push(s.queue, request)
+
+	if o.config.Stats {
+		o.queueStats.Write(len(s.queue))
+	}
+
+	o.sessionsMu.Lock()
+	if s.writers--; s.writers == 0 && s.evicted {
+		close(s.queue)
+	}
+	o.sessionsMu.Unlock()
+}
+
+func (o *UDPOutPut) evictSession() {
+	var oldest *udpSession
+	for _, s := range o.sessions {
+		if oldest == nil || s.lastUsed.Before(oldest.lastUsed) {
+			oldest = s
+		}
+	}
+
+	// Session sends what is already queued and closes its sockets
+	delete(o.sessions, oldest.key)
+	if oldest.writers > 0 {
+		oldest.evicted = true
+		return
+	}
+	close(oldest.queue)
+}
+
+func (o *UDPOutPut) runSession(s *udpSession) {
+	clients := make(map[uint16]*client.UDPClient)
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+
+	for {
+		select {
+		case data, ok := <-s.queue:
+			if !ok {
+				return
+			}
+
+			if c := o.client(clients, data); c != nil {
+				o.sendRequest(c, data)
+			}
+			o.done(data)
+		case <-time.After(o.config.SessionTimeout):
+			o.sessionsMu.Lock()
+			if len(s.queue) == 0 && s.writers == 0 && o.sessions[s.key] == s {
+				delete(o.sessions, s.key)
+				o.sessionsMu.Unlock()
+				return
+			}
+			o.sessionsMu.Unlock()
+		}
+	}
+}
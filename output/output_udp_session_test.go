@@ -0,0 +1,173 @@
+package output
+
+import (
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/myzhan/goreplay-udp/proto"
+	"github.com/myzhan/goreplay-udp/stats"
+)
+
+// testServer records source address of each received datagram by its body
+type testServer struct {
+	conn    net.PacketConn
+	sources chan [2]string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{conn: conn, sources: make(chan [2]string, 100)}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			s.sources <- [2]string{string(buf[:n]), addr.String()}
+		}
+	}()
+
+	return s
+}
+
+// receive returns source address of the next datagram, which should have the given body
+func (s *testServer) receive(t *testing.T, body string) string {
+	t.Helper()
+
+	select {
+	case got := <-s.sources:
+		if got[0] != body {
+			t.Fatalf("received %q, expected %q", got[0], body)
+		}
+		return got[1]
+	case <-time.After(time.Second):
+		t.Fatalf("%q is not received", body)
+	}
+
+	return ""
+}
+
+func sessionRequest(client string, body string) []byte {
+	header := proto.PayloadExtendedHeader(proto.RequestPayload, []byte("f45590522cd1838b4a0d5c5aab80b77929dea3b3"), 1, 53, proto.MetaClient, client)
+	return append(header, body...)
+}
+
+func newSessionOutput(t *testing.T, s *testServer, maxSessions int) *UDPOutPut {
+	t.Helper()
+
+	return NewUDPOutput(s.conn.LocalAddr().String(), &UDPOutputConfig{
+		Timeout:         time.Second,
+		IgnoreResponse:  true,
+		QueueSize:       10,
+		QueuePolicy:     stats.QueueBlock,
+		SessionAffinity: true,
+		SessionTimeout:  200 * time.Millisecond,
+		MaxSessions:     maxSessions,
+	})
+}
+
+// sessionKeys returns clients with open sessions
+func sessionKeys(o *UDPOutPut) []string {
+	o.sessionsMu.Lock()
+	defer o.sessionsMu.Unlock()
+
+	var keys []string
+	for key := range o.sessions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func TestUDPSessionCreate(t *testing.T) {
+	s := newTestServer(t)
+	defer s.conn.Close()
+
+	o := newSessionOutput(t, s, 10)
+	defer o.Close()
+
+	o.Write(sessionRequest("10.0.0.1:1000", "a1"))
+	a := s.receive(t, "a1")
+	o.Write(sessionRequest("10.0.0.2:1000", "b1"))
+	b := s.receive(t, "b1")
+	o.Write(sessionRequest("10.0.0.1:1000", "a2"))
+
+	// Each captured client is replayed from its own socket
+	if a2 := s.receive(t, "a2"); a2 != a {
+		t.Errorf("session sends from %s, then from %s", a, a2)
+	}
+	if a == b {
+		t.Errorf("clients share socket %s", a)
+	}
+
+	if keys := sessionKeys(o); len(keys) != 2 || keys[0] != "10.0.0.1:1000" || keys[1] != "10.0.0.2:1000" {
+		t.Errorf("unexpected sessions %v", keys)
+	}
+
+	o.sessionsMu.Lock()
+	if size := cap(o.sessions["10.0.0.1:1000"].queue); size != o.config.QueueSize {
+		t.Errorf("session queue of %d requests, expected %d", size, o.config.QueueSize)
+	}
+	o.sessionsMu.Unlock()
+}
+
+func TestUDPSessionTimeout(t *testing.T) {
+	s := newTestServer(t)
+	defer s.conn.Close()
+
+	o := newSessionOutput(t, s, 10)
+	defer o.Close()
+
+	o.Write(sessionRequest("10.0.0.1:1000", "a1"))
+	s.receive(t, "a1")
+
+	time.Sleep(100 * time.Millisecond)
+	if keys := sessionKeys(o); len(keys) != 1 {
+		t.Fatalf("session expired before timeout, sessions %v", keys)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if keys := sessionKeys(o); len(keys) != 0 {
+		t.Fatalf("idle session isn't closed, sessions %v", keys)
+	}
+
+	// The next request opens a new session
+	o.Write(sessionRequest("10.0.0.1:1000", "a2"))
+	s.receive(t, "a2")
+	if keys := sessionKeys(o); len(keys) != 1 {
+		t.Errorf("expected new session, sessions %v", keys)
+	}
+}
+
+func TestUDPSessionEviction(t *testing.T) {
+	s := newTestServer(t)
+	defer s.conn.Close()
+
+	o := newSessionOutput(t, s, 2)
+	defer o.Close()
+
+	o.Write(sessionRequest("10.0.0.1:1000", "a1"))
+	s.receive(t, "a1")
+	o.Write(sessionRequest("10.0.0.2:1000", "b1"))
+	s.receive(t, "b1")
+	// Used more recently than b
+	o.Write(sessionRequest("10.0.0.1:1000", "a2"))
+	s.receive(t, "a2")
+
+	o.Write(sessionRequest("10.0.0.3:1000", "c1"))
+	s.receive(t, "c1")
+
+	if keys := sessionKeys(o); len(keys) != 2 || keys[0] != "10.0.0.1:1000" || keys[1] != "10.0.0.3:1000" {
+		t.Errorf("expected least recently used session evicted, got %v", keys)
+	}
+}
@@ -0,0 +1,44 @@
+package output
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+var spillDirReplacer = strings.NewReplacer(":", "_", "/", "_", "%", "_", "*", "any", "[", "", "]", "")
+
+// spillDirName makes directory name of output address, e.g. `staging.com_53`
+func spillDirName(address string) string {
+	return spillDirReplacer.Replace(address)
+}
+
+// unspill moves requests from disk to workers, as fast as they take them
+func (o *UDPOutPut) unspill() {
+	for {
+		request, ok := o.spill.pop()
+		if !ok {
+			return
+		}
+
+		o.enqueue(request)
+	}
+}
+
+// reportSpill prints backlog every 5 seconds while there is one
+func (o *UDPOutPut) reportSpill() {
+	var lastDropped int64
+
+	for {
+		time.Sleep(5 * time.Second)
+
+		depth, size, age, dropped := o.spill.stats()
+		if depth == 0 && dropped == lastDropped {
+			continue
+		}
+		lastDropped = dropped
+
+		log.Printf("output_udp_spill %s:depth %d, size %.1fMB, age %s, dropped %d\n",
+			o.address, depth, float64(size)/1024/1024, age.Truncate(time.Millisecond), dropped)
+	}
+}
@@ -0,0 +1,67 @@
+package output
+
+import (
+	"net"
+	"syscall"
+)
+
+// Not exported by syscall package
+const ipv6HdrIncl = 36
+
+// rawSocket sends IP packets with headers built by the caller, of one address family
+type rawSocket struct {
+	fd   int
+	ipv6 bool
+}
+
+// newRawSocket opens socket only for family of the target, so IPv4 works where IPv6 is disabled
+func newRawSocket(ipv6 bool) (s *rawSocket, err error) {
+	s = &rawSocket{fd: -1, ipv6: ipv6}
+
+	if !ipv6 {
+		// IPPROTO_RAW implies IP_HDRINCL
+		if s.fd, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW); err != nil {
+			return nil, err
+		}
+
+		return s, nil
+	}
+
+	if s.fd, err = syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_RAW); err != nil {
+		return nil, err
+	}
+
+	if err = syscall.SetsockoptInt(s.fd, syscall.IPPROTO_IPV6, ipv6HdrIncl, 1); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// send returns errPacketTooBig if packet exceeds MTU of outgoing interface, kernel doesn't fragment it
+func (s *rawSocket) send(dst net.IP, packet []byte) (err error) {
+	if s.ipv6 {
+		addr := &syscall.SockaddrInet6{}
+		copy(addr.Addr[:], dst.To16())
+		err = syscall.Sendto(s.fd, packet, 0, addr)
+	} else {
+		addr := &syscall.SockaddrInet4{}
+		copy(addr.Addr[:], dst.To4())
+		err = syscall.Sendto(s.fd, packet, 0, addr)
+	}
+
+	if err == syscall.EMSGSIZE {
+		return errPacketTooBig
+	}
+
+	return err
+}
+
+func (s *rawSocket) Close() error {
+	if s.fd != -1 {
+		syscall.Close(s.fd)
+	}
+
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package output
+
+import (
+	"errors"
+	"net"
+)
+
+type rawSocket struct{}
+
+func newRawSocket(ipv6 bool) (*rawSocket, error) {
+	return nil, errors.New("raw socket output is supported only on Linux")
+}
+
+func (s *rawSocket) send(dst net.IP, packet []byte) error {
+	return nil
+}
+
+func (s *rawSocket) Close() error {
+	return nil
+}
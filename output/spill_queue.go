@@ -0,0 +1,435 @@
+package output
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/myzhan/goreplay-udp/proto"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spillSegmentSuffix = ".seg"
+	spillCursorFile    = "cursor"
+	// Sent position is saved every spillCursorEvery records, on segment removal and on close
+	spillCursorEvery = 1000
+)
+
+// spillQueue is FIFO of payloads persisted in segment files of a directory, capped by their total size.
+// Every record is proto.WriteRecord of 8 bytes enqueue time and payload. Popped payloads are passed
+// back to done once sent, position before the oldest payload not done yet is saved in cursor file,
+// so after restart reading resumes from it. Records done after the last save are read again,
+// and with a crash in the middle of write the last record of a segment is lost.
+type spillQueue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	dir         string
+	maxSize     int64
+	segmentSize int64
+
+	// Segment sequence numbers, oldest first, segments before the cursor are removed
+	segments []int64
+	// Size of all segment files
+	size int64
+
+	writeFile *os.File
+	writeSize int64
+
+	readSeq    int64
+	readFile   *os.File
+	reader     *bufio.Reader
+	readOffset int64
+
+	// Popped records in read order, and the ones not done yet by their payload
+	popped    []*spillRecord
+	unsent    map[*byte]*spillRecord
+	cursor    spillRecord
+	sinceSave int
+
+	// Records not read yet, and enqueue time of the last read one, approximating the oldest waiting one
+	depth    int64
+	lastRead time.Time
+
+	dropped int64
+	closed  bool
+}
+
+// spillRecord is position after a popped record
+type spillRecord struct {
+	seq    int64
+	offset int64
+	done   bool
+}
+
+// newSpillQueue opens queue in directory, creating it if needed. maxSize is in bytes.
+func newSpillQueue(dir string, maxSize int64) (*spillQueue, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	q := &spillQueue{dir: dir, maxSize: maxSize, unsent: make(map[*byte]*spillRecord)}
+	q.cond = sync.NewCond(&q.mu)
+
+	q.segmentSize = maxSize / 8
+	if q.segmentSize > 64*1024*1024 {
+		q.segmentSize = 64 * 1024 * 1024
+	}
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func (q *spillQueue) segmentPath(seq int64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, spillSegmentSuffix))
+}
+
+// load finds segments and read position left by previous run, and opens new segment for writing
+func (q *spillQueue) load() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), spillSegmentSuffix) {
+			continue
+		}
+
+		seq, err := strconv.ParseInt(strings.TrimSuffix(f.Name(), spillSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, seq)
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+
+	cursor := spillRecord{seq: -1}
+	if data, err := ioutil.ReadFile(filepath.Join(q.dir, spillCursorFile)); err == nil {
+		if _, err := fmt.Sscan(string(data), &cursor.seq, &cursor.offset); err != nil {
+			log.Println("Spill queue: ignoring broken cursor file in", q.dir, err)
+			cursor = spillRecord{seq: -1}
+		}
+	}
+
+	// Segments before the cursor are already sent
+	for len(q.segments) > 0 && q.segments[0] < cursor.seq {
+		os.Remove(q.segmentPath(q.segments[0]))
+		q.segments = q.segments[1:]
+	}
+	if len(q.segments) > 0 && q.segments[0] == cursor.seq {
+		q.readOffset = cursor.offset
+	}
+
+	for i, seq := range q.segments {
+		info, err := os.Stat(q.segmentPath(seq))
+		if err != nil {
+			return err
+		}
+		q.size += info.Size()
+
+		offset := int64(0)
+		if i == 0 {
+			offset = q.readOffset
+		}
+		if err := q.count(seq, offset); err != nil {
+			return err
+		}
+	}
+
+	next := int64(0)
+	if len(q.segments) > 0 {
+		next = q.segments[len(q.segments)-1] + 1
+	}
+	if err := q.openWriteSegment(next); err != nil {
+		return err
+	}
+
+	if q.depth > 0 {
+		log.Printf("Spill queue: resuming %d records from %s\n", q.depth, q.dir)
+	}
+
+	if err := q.openReadSegment(q.segments[0], q.readOffset); err != nil {
+		return err
+	}
+	q.cursor = spillRecord{seq: q.readSeq, offset: q.readOffset}
+
+	return nil
+}
+
+// count adds records of segment after offset to depth, lastRead is set to time of the first one
+func (q *spillQueue) count(seq int64, offset int64) error {
+	f, err := os.Open(q.segmentPath(seq))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		record, err := proto.ReadRecord(r)
+		if err != nil {
+			return nil
+		}
+
+		if q.depth == 0 && len(record) >= 8 {
+			q.lastRead = time.Unix(0, int64(binary.BigEndian.Uint64(record)))
+		}
+		q.depth++
+	}
+}
+
+func (q *spillQueue) openWriteSegment(seq int64) error {
+	f, err := os.OpenFile(q.segmentPath(seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+
+	if q.writeFile != nil {
+		q.writeFile.Close()
+	}
+
+	q.writeFile = f
+	q.writeSize = 0
+	q.segments = append(q.segments, seq)
+
+	return nil
+}
+
+func (q *spillQueue) openReadSegment(seq int64, offset int64) error {
+	f, err := os.Open(q.segmentPath(seq))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	if q.readFile != nil {
+		q.readFile.Close()
+	}
+
+	q.readSeq = seq
+	q.readFile = f
+	q.reader = bufio.NewReader(f)
+	q.readOffset = offset
+
+	return nil
+}
+
+// push appends payload, it is dropped if queue is full
+func (q *spillQueue) push(payload []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	recordSize := int64(4 + 8 + len(payload))
+	if q.closed || q.size+recordSize > q.maxSize {
+		q.dropped++
+		return nil
+	}
+
+	if q.writeSize >= q.segmentSize {
+		if err := q.openWriteSegment(q.segments[len(q.segments)-1] + 1); err != nil {
+			return err
+		}
+	}
+
+	record := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint64(record, uint64(time.Now().UnixNano()))
+	copy(record[8:], payload)
+
+	if err := proto.WriteRecord(q.writeFile, record); err != nil {
+		return err
+	}
+
+	if q.depth == 0 {
+		q.lastRead = time.Unix(0, int64(binary.BigEndian.Uint64(record)))
+	}
+
+	q.size += recordSize
+	q.writeSize += recordSize
+	q.depth++
+	q.cond.Signal()
+
+	return nil
+}
+
+// pop waits for the next payload, returns false when queue is closed.
+// Payload is unsent until it is passed to done.
+func (q *spillQueue) pop() ([]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		for q.depth == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			return nil, false
+		}
+
+		record, err := proto.ReadRecord(q.reader)
+		if err != nil {
+			// Reader is ahead of writer only at the end of a segment, broken tail is skipped too
+			if q.readSeq < q.segments[len(q.segments)-1] {
+				q.nextReadSegment()
+				continue
+			}
+
+			log.Println("Spill queue: can't read", q.dir, err)
+			q.depth = 0
+			continue
+		}
+
+		q.readOffset += int64(4 + len(record))
+		q.depth--
+
+		if len(record) <= 8 {
+			q.commit()
+			continue
+		}
+		q.lastRead = time.Unix(0, int64(binary.BigEndian.Uint64(record)))
+
+		r := &spillRecord{seq: q.readSeq, offset: q.readOffset}
+		q.popped = append(q.popped, r)
+		q.unsent[&record[8]] = r
+
+		return record[8:], true
+	}
+}
+
+// done marks payload returned by pop as sent, and moves cursor past records sent so far
+func (q *spillQueue) done(payload []byte) {
+	if len(payload) == 0 {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	r, ok := q.unsent[&payload[0]]
+	if !ok {
+		return
+	}
+	delete(q.unsent, &payload[0])
+	r.done = true
+
+	q.commit()
+
+	// Records left are read by the next run from here
+	if q.closed {
+		q.saveCursor()
+	}
+}
+
+// unsentCount returns how many popped payloads are not done yet
+func (q *spillQueue) unsentCount() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.unsent)
+}
+
+// commit moves cursor past sent records until the oldest unsent one, and removes segments before it
+func (q *spillQueue) commit() {
+	for len(q.popped) > 0 && q.popped[0].done {
+		q.cursor = *q.popped[0]
+		q.popped = q.popped[1:]
+		q.sinceSave++
+	}
+	if len(q.popped) == 0 {
+		q.cursor = spillRecord{seq: q.readSeq, offset: q.readOffset}
+	}
+
+	removed := false
+	for q.segments[0] < q.cursor.seq {
+		if info, err := os.Stat(q.segmentPath(q.segments[0])); err == nil {
+			q.size -= info.Size()
+		}
+		os.Remove(q.segmentPath(q.segments[0]))
+		q.segments = q.segments[1:]
+		removed = true
+	}
+
+	if removed || q.sinceSave >= spillCursorEvery {
+		q.saveCursor()
+	}
+}
+
+// nextReadSegment starts reading segment after the fully read one, it is removed once its records are sent
+func (q *spillQueue) nextReadSegment() {
+	for _, seq := range q.segments {
+		if seq <= q.readSeq {
+			continue
+		}
+
+		// Broken segment is skipped, reader stays at the end of the previous one
+		if err := q.openReadSegment(seq, 0); err != nil {
+			log.Println("Spill queue: can't open segment", err)
+			q.readSeq, q.readOffset = seq, 0
+		}
+		break
+	}
+
+	q.commit()
+}
+
+func (q *spillQueue) saveCursor() {
+	q.sinceSave = 0
+
+	path := filepath.Join(q.dir, spillCursorFile)
+	data := fmt.Sprintf("%d %d\n", q.cursor.seq, q.cursor.offset)
+
+	if err := ioutil.WriteFile(path+".tmp", []byte(data), 0640); err != nil {
+		log.Println("Spill queue: can't save cursor", err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		log.Println("Spill queue: can't save cursor", err)
+	}
+}
+
+// stats returns records waiting, their size on disk, age of the oldest one and dropped records count
+func (q *spillQueue) stats() (depth int64, size int64, age time.Duration, dropped int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.depth > 0 && !q.lastRead.IsZero() {
+		age = time.Since(q.lastRead)
+	}
+
+	return q.depth, q.size, age, q.dropped
+}
+
+// Close stops pop and saves position before the oldest unsent record, records left are read after restart
+func (q *spillQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	q.cond.Broadcast()
+
+	q.saveCursor()
+	q.readFile.Close()
+	return q.writeFile.Close()
+}
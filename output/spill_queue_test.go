@@ -0,0 +1,230 @@
+package output
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openSpill(t *testing.T, dir string, maxSize int64) *spillQueue {
+	t.Helper()
+
+	q, err := newSpillQueue(dir, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return q
+}
+
+func pushN(t *testing.T, q *spillQueue, from, to int) {
+	t.Helper()
+
+	for i := from; i < to; i++ {
+		if err := q.push([]byte(fmt.Sprintf("req-%02d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// popExpect pops payload and checks it is the expected one
+func popExpect(t *testing.T, q *spillQueue, expected int) []byte {
+	t.Helper()
+
+	payload, ok := q.pop()
+	if !ok {
+		t.Fatalf("queue is closed, expected req-%02d", expected)
+	}
+	if string(payload) != fmt.Sprintf("req-%02d", expected) {
+		t.Fatalf("popped %q, expected req-%02d", payload, expected)
+	}
+
+	return payload
+}
+
+func TestSpillQueueOrder(t *testing.T) {
+	q := openSpill(t, t.TempDir(), 1024*1024)
+	defer q.Close()
+
+	pushN(t, q, 0, 5)
+
+	var popped [][]byte
+	for i := 0; i < 5; i++ {
+		popped = append(popped, popExpect(t, q, i))
+	}
+
+	if n := q.unsentCount(); n != 5 {
+		t.Errorf("expected 5 unsent, got %d", n)
+	}
+
+	// Cursor stays before the oldest unsent payload
+	q.done(popped[1])
+	q.done(popped[2])
+	if q.cursor.offset != 0 {
+		t.Errorf("cursor moved past unsent payload: %+v", q.cursor)
+	}
+
+	q.done(popped[0])
+	q.done(popped[4])
+	if n := q.unsentCount(); n != 1 {
+		t.Errorf("expected 1 unsent, got %d", n)
+	}
+
+	// Each record is 4 bytes length, 8 bytes time and 6 bytes payload
+	if q.cursor.offset != 3*18 {
+		t.Errorf("expected cursor after 3 records, got %+v", q.cursor)
+	}
+
+	// Done twice or unknown payload is ignored
+	q.done(popped[0])
+	q.done([]byte("req-03"))
+
+	q.done(popped[3])
+	if q.cursor.offset != 5*18 || q.unsentCount() != 0 {
+		t.Errorf("expected cursor after all records, got %+v", q.cursor)
+	}
+}
+
+func TestSpillQueueResume(t *testing.T) {
+	dir := t.TempDir()
+
+	q := openSpill(t, dir, 1024*1024)
+	pushN(t, q, 0, 5)
+
+	a := popExpect(t, q, 0)
+	b := popExpect(t, q, 1)
+	popExpect(t, q, 2)
+	q.done(a)
+	q.done(b)
+	// req-02 is popped and not sent
+	q.Close()
+
+	if _, ok := q.pop(); ok {
+		t.Error("closed queue pops payload")
+	}
+
+	q = openSpill(t, dir, 1024*1024)
+	if depth, _, _, _ := q.stats(); depth != 3 {
+		t.Errorf("expected 3 records after reopen, got %d", depth)
+	}
+	c := popExpect(t, q, 2)
+	q.Close()
+
+	// Sent after close, e.g. while output drains, the next run doesn't read it again
+	q.done(c)
+
+	q = openSpill(t, dir, 1024*1024)
+	defer q.Close()
+
+	popExpect(t, q, 3)
+	popExpect(t, q, 4)
+}
+
+func TestSpillQueueSegments(t *testing.T) {
+	dir := t.TempDir()
+
+	// Segments of 100 bytes, record is 18 bytes, so a segment takes 6 records
+	q := openSpill(t, dir, 800)
+	defer q.Close()
+
+	pushN(t, q, 0, 14)
+	if len(q.segments) != 3 {
+		t.Fatalf("expected 3 segments, got %v", q.segments)
+	}
+
+	var popped [][]byte
+	for i := 0; i < 8; i++ {
+		popped = append(popped, popExpect(t, q, i))
+	}
+
+	// Segment is kept until all of its records are sent
+	for _, payload := range popped[1:] {
+		q.done(payload)
+	}
+	if len(q.segments) != 3 {
+		t.Errorf("segment with unsent record is removed: %v", q.segments)
+	}
+
+	q.done(popped[0])
+	if len(q.segments) != 2 || q.segments[0] != 1 {
+		t.Errorf("expected the first segment removed, got %v", q.segments)
+	}
+	if _, err := os.Stat(q.segmentPath(0)); !os.IsNotExist(err) {
+		t.Errorf("segment file is not removed: %v", err)
+	}
+	if q.size != 8*18 {
+		t.Errorf("expected size of 8 records left, got %d", q.size)
+	}
+
+	for i := 8; i < 14; i++ {
+		q.done(popExpect(t, q, i))
+	}
+	if len(q.segments) != 1 || q.segments[0] != 2 {
+		t.Errorf("expected only write segment left, got %v", q.segments)
+	}
+}
+
+func TestSpillQueueMaxSize(t *testing.T) {
+	q := openSpill(t, t.TempDir(), 100)
+	defer q.Close()
+
+	// Record is 18 bytes, 5 of them fit
+	pushN(t, q, 0, 8)
+
+	depth, size, _, dropped := q.stats()
+	if depth != 5 || size != 5*18 || dropped != 3 {
+		t.Errorf("depth %d, size %d, dropped %d", depth, size, dropped)
+	}
+
+	// Space is freed once records are sent
+	for i := 0; i < 5; i++ {
+		q.done(popExpect(t, q, i))
+	}
+	pushN(t, q, 8, 9)
+	popExpect(t, q, 8)
+}
+
+func TestSpillQueueBrokenFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	q := openSpill(t, dir, 1024*1024)
+	pushN(t, q, 0, 3)
+	q.done(popExpect(t, q, 0))
+	q.Close()
+
+	// Broken cursor, all records are read again
+	if err := ioutil.WriteFile(filepath.Join(dir, spillCursorFile), []byte("broken"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	q = openSpill(t, dir, 1024*1024)
+	if depth, _, _, _ := q.stats(); depth != 3 {
+		t.Errorf("expected 3 records with broken cursor, got %d", depth)
+	}
+	q.Close()
+
+	// Crash in the middle of write leaves truncated record at the end of segment
+	path := q.segmentPath(0)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	q = openSpill(t, dir, 1024*1024)
+	defer q.Close()
+
+	if depth, _, _, _ := q.stats(); depth != 2 {
+		t.Errorf("expected 2 records with truncated tail, got %d", depth)
+	}
+
+	// Broken tail is skipped, new records are read from the next segment
+	pushN(t, q, 3, 4)
+	popExpect(t, q, 0)
+	popExpect(t, q, 1)
+	popExpect(t, q, 3)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"github.com/myzhan/goreplay-udp/stats"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// queuedOutput writes to the output from its own goroutine, so a slow output doesn't hold up
+// inputs and other outputs. Payload is copied, because CopyMulty reuses its buffer.
+type queuedOutput struct {
+	// Payloads accepted by Write and not written yet, first for 64bit alignment
+	pending int64
+
+	plugin io.Writer
+	queue  chan []byte
+	policy string
+	drops  *stats.Counter
+}
+
+func newQueuedOutput(plugin io.Writer, size int, policy string) *queuedOutput {
+	if err := stats.ValidateQueue("output-queue", size, policy); err != nil {
+		log.Fatal(err)
+	}
+
+	o := &queuedOutput{
+		plugin: plugin,
+		queue:  make(chan []byte, size),
+		policy: policy,
+		drops:  stats.NewDropCounter(fmt.Sprint("output_queue ", plugin)),
+	}
+
+	go o.run()
+
+	return o
+}
+
+func (o *queuedOutput) Write(data []byte) (int, error) {
+	buf := make([]byte, len(data))
+	copy(buf, data)
+
+	atomic.AddInt64(&o.pending, 1)
+
+	switch o.policy {
+	case stats.QueueDropNewest:
+		select {
+		case o.queue <- buf:
+		default:
+			o.drop()
+		}
+	case stats.QueueDropOldest:
+		for {
+			select {
+			case o.queue <- buf:
+				return len(data), nil
+			default:
+			}
+
+			select {
+			case <-o.queue:
+				o.drop()
+			default:
+			}
+		}
+	default:
+		o.queue <- buf
+	}
+
+	return len(data), nil
+}
+
+func (o *queuedOutput) drop() {
+	o.drops.Add(1)
+	atomic.AddInt64(&o.pending, -1)
+}
+
+func (o *queuedOutput) run() {
+	for payload := range o.queue {
+		o.plugin.Write(payload)
+		atomic.AddInt64(&o.pending, -1)
+	}
+}
+
+// flush waits until queued payloads are written to the output, or deadline passes
+func (o *queuedOutput) flush(deadline time.Time) bool {
+	for atomic.LoadInt64(&o.pending) > 0 {
+		if time.Now().After(deadline) {
+			log.Printf("%s: %d payloads are not written before drain deadline\n", o.plugin, atomic.LoadInt64(&o.pending))
+			return false
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return true
+}
+
+// Drain flushes the queue, then drains the output itself
+func (o *queuedOutput) Drain(deadline time.Time) bool {
+	if !o.flush(deadline) {
+		return false
+	}
+
+	if d, ok := o.plugin.(drainer); ok {
+		return d.Drain(deadline)
+	}
+
+	return true
+}
+
+func (o *queuedOutput) String() string {
+	return fmt.Sprint(o.plugin)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/myzhan/goreplay-udp/stats"
+)
+
+// blockedWriter holds each write until release is closed
+type blockedWriter struct {
+	started chan struct{}
+	release chan struct{}
+
+	mu      sync.Mutex
+	written []string
+}
+
+func newBlockedWriter() *blockedWriter {
+	return &blockedWriter{started: make(chan struct{}, 100), release: make(chan struct{})}
+}
+
+func (w *blockedWriter) Write(data []byte) (int, error) {
+	w.started <- struct{}{}
+	<-w.release
+
+	w.mu.Lock()
+	w.written = append(w.written, string(data))
+	w.mu.Unlock()
+
+	return len(data), nil
+}
+
+func (w *blockedWriter) String() string {
+	return "blocked writer"
+}
+
+func TestQueuedOutputPolicies(t *testing.T) {
+	tests := []struct {
+		policy  string
+		written string
+		dropped int64
+	}{
+		{stats.QueueBlock, "1 2 3 4 5", 0},
+		{stats.QueueDropNewest, "1 2 3", 2},
+		{stats.QueueDropOldest, "1 4 5", 2},
+	}
+
+	for _, tt := range tests {
+		w := newBlockedWriter()
+		q := newQueuedOutput(w, 2, tt.policy)
+
+		// Output is busy with the first payload, the next two fill the queue
+		q.Write([]byte("1"))
+		<-w.started
+
+		buf := []byte("2")
+		q.Write(buf)
+		// Payload is copied, writer may reuse its buffer
+		buf[0] = '3'
+		q.Write(buf)
+
+		overflow := make(chan struct{})
+		go func() {
+			q.Write([]byte("4"))
+			q.Write([]byte("5"))
+			close(overflow)
+		}()
+
+		select {
+		case <-overflow:
+			if tt.policy == stats.QueueBlock {
+				t.Errorf("%s: write to full queue doesn't wait", tt.policy)
+			}
+		case <-time.After(50 * time.Millisecond):
+			if tt.policy != stats.QueueBlock {
+				t.Errorf("%s: write to full queue waits", tt.policy)
+			}
+		}
+
+		close(w.release)
+		<-overflow
+
+		if !q.flush(time.Now().Add(time.Second)) {
+			t.Fatalf("%s: queue is not flushed", tt.policy)
+		}
+
+		w.mu.Lock()
+		written := strings.Join(w.written, " ")
+		w.mu.Unlock()
+
+		if written != tt.written {
+			t.Errorf("%s: written %q, expected %q", tt.policy, written, tt.written)
+		}
+		if dropped := q.drops.Count(); dropped != tt.dropped {
+			t.Errorf("%s: dropped %d, expected %d", tt.policy, dropped, tt.dropped)
+		}
+	}
+}
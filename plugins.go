@@ -90,18 +90,30 @@ func InitPlugins() {
 	}
 
 	for _, options := range Settings.inputUDP {
-		registerPlugin(input.NewUDPInput, options, Settings.inputUDPTrackResponse)
+		registerPlugin(input.NewUDPInput, options, &Settings.inputUDPConfig)
 	}
 
 	for _, options := range Settings.inputFile {
 		registerPlugin(input.NewFileInput, options, Settings.inputFileLoop)
 	}
 
+	for _, options := range Settings.inputPcap {
+		registerPlugin(input.NewPcapInput, options, Settings.inputPcapAddress, &Settings.inputUDPConfig)
+	}
+
 	for _, options := range Settings.outputFile {
 		registerPlugin(output.NewFileOutput, options, &Settings.outputFileConfig)
 	}
 
+	for _, options := range Settings.outputDiff {
+		registerPlugin(output.NewDiffOutput, options, &Settings.outputDiffConfig)
+	}
+
 	for _, options := range Settings.outputUDP {
 		registerPlugin(output.NewUDPOutput, options, &Settings.outputUDPConfig)
 	}
+
+	for _, options := range Settings.outputRawUDP {
+		registerPlugin(output.NewRawUDPOutput, options, &Settings.outputRawUDPConfig)
+	}
 }
@@ -0,0 +1,36 @@
+package proto
+
+import "sync"
+
+// Buffers fit a datagram captured with MTU 1500 and link headers, larger ones are allocated
+const bufferSize = 2048
+
+// Pointers are pooled, so Put doesn't allocate slice header
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, bufferSize)
+		return &buf
+	},
+}
+
+// GetBuffer returns buffer of given length, from the pool if it fits.
+// Buffer has a single owner at a time, the last one returns it by PutBuffer.
+func GetBuffer(length int) *[]byte {
+	if length > bufferSize {
+		buf := make([]byte, length)
+		return &buf
+	}
+
+	buf := bufferPool.Get().(*[]byte)
+	*buf = (*buf)[:length]
+	return buf
+}
+
+// PutBuffer returns buffer to the pool, it must not be used after that
+func PutBuffer(buf *[]byte) {
+	if buf == nil || cap(*buf) != bufferSize {
+		return
+	}
+
+	bufferPool.Put(buf)
+}
@@ -0,0 +1,31 @@
+package proto
+
+import "testing"
+
+// Captured datagram with addresses, buildPacket copies one per packet
+var benchmarkPacket = make([]byte, 1500)
+
+var benchmarkSink []byte
+
+// BenchmarkBufferCopy allocates a copy per packet, like capture did before pooled buffers
+func BenchmarkBufferCopy(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		buf := make([]byte, len(benchmarkPacket))
+		copy(buf, benchmarkPacket)
+		benchmarkSink = buf
+	}
+}
+
+// BenchmarkBufferPooled copies packet to pooled buffer, which is released after the message is read
+func BenchmarkBufferPooled(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		buf := GetBuffer(len(benchmarkPacket))
+		copy(*buf, benchmarkPacket)
+		benchmarkSink = *buf
+		PutBuffer(buf)
+	}
+}
@@ -13,28 +13,66 @@ const (
 
 var PayloadSeparator = "\n🐵🙈🙉\n"
 
-func PayloadHeader(payloadType byte, uuid []byte, timing int64) (header []byte) {
-	var sTime string
+// Extended header fields, written as key=value after the listening port.
+// Readers of the original header only look at type, id and timestamp, so files stay compatible both ways.
+const (
+	MetaClient    = "client"
+	MetaServer    = "server"
+	MetaInterface = "iface"
+	MetaTTL       = "ttl"
+	MetaTOS       = "tos"
+	MetaEncap     = "encap"
+	// Server latency of paired response, in nanoseconds
+	MetaLatency = "latency"
+)
+
+func PayloadHeader(payloadType byte, uuid []byte, timing int64, port uint16) (header []byte) {
+	var sTime, sPort string
 
 	sTime = strconv.FormatInt(timing, 10)
+	sPort = strconv.Itoa(int(port))
 
 	//Example:
-	// 3 f45590522cd1838b4a0d5c5aab80b77929dea3b3 1231\n
+	// 3 f45590522cd1838b4a0d5c5aab80b77929dea3b3 1231 53\n
 	// `+ 1` indicates space characters or end of line
-	headerLen := 1 + 1 + len(uuid) + 1 + len(sTime) + 1
+	headerLen := 1 + 1 + len(uuid) + 1 + len(sTime) + 1 + len(sPort) + 1
 
 	header = make([]byte, headerLen)
 	header[0] = payloadType
 	header[1] = ' '
 	header[2+len(uuid)] = ' '
+	header[3+len(uuid)+len(sTime)] = ' '
 	header[len(header)-1] = '\n'
 
 	copy(header[2:], uuid)
 	copy(header[3+len(uuid):], sTime)
+	copy(header[4+len(uuid)+len(sTime):], sPort)
 
 	return header
 }
 
+// PayloadExtendedHeader appends fields to PayloadHeader, fields go in pairs of key and value.
+// Fields with empty value are skipped.
+func PayloadExtendedHeader(payloadType byte, uuid []byte, timing int64, port uint16, fields ...string) (header []byte) {
+	header = PayloadHeader(payloadType, uuid, timing, port)
+	header = header[:len(header)-1]
+
+	//Example:
+	// 1 f45590522cd1838b4a0d5c5aab80b77929dea3b3 1231 53 client=10.0.0.1:5353 server=10.0.0.2:53 iface=eth0 ttl=64 tos=0\n
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i+1] == "" {
+			continue
+		}
+
+		header = append(header, ' ')
+		header = append(header, fields[i]...)
+		header = append(header, '=')
+		header = append(header, fields[i+1]...)
+	}
+
+	return append(header, '\n')
+}
+
 func PayloadBody(payload []byte) []byte {
 	headerSize := bytes.IndexByte(payload, '\n')
 	return payload[headerSize+1:]
@@ -48,6 +86,33 @@ func PayloadMeta(payload []byte) [][]byte {
 	return bytes.Split(payload[:headerSize], []byte{' '})
 }
 
+// PayloadListenPort returns captured listening port, or 0 for payloads recorded without it
+func PayloadListenPort(payload []byte) uint16 {
+	meta := PayloadMeta(payload)
+	if len(meta) < 4 {
+		return 0
+	}
+
+	port, _ := strconv.ParseUint(string(meta[3]), 10, 16)
+	return uint16(port)
+}
+
+// PayloadMetaValue returns value of extended header field, or nil if payload doesn't have it
+func PayloadMetaValue(payload []byte, key string) []byte {
+	meta := PayloadMeta(payload)
+	if len(meta) < 4 {
+		return nil
+	}
+
+	for _, field := range meta[4:] {
+		if len(field) > len(key) && field[len(key)] == '=' && string(field[:len(key)]) == key {
+			return field[len(key)+1:]
+		}
+	}
+
+	return nil
+}
+
 func IsRequestPayload(payload []byte) bool {
 	return payload[0] == RequestPayload
 }
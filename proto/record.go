@@ -0,0 +1,88 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Record file starts with FileMagic followed by version byte, then every payload is written as
+// 4 bytes big-endian length and payload itself. Unlike PayloadSeparator, it is safe for any binary payload.
+var FileMagic = []byte("GORUDP\x00")
+
+const (
+	RecordFormatVersion = 1
+
+	// Sanity limit, payloads are single UDP datagrams with header
+	maxRecordSize = 64 * 1024 * 1024
+)
+
+var ErrRecordTooLarge = errors.New("record is too large, file may be corrupted")
+
+// WriteFileHeader writes magic and format version, must be called once at the beginning of file
+func WriteFileHeader(w io.Writer) error {
+	if _, err := w.Write(FileMagic); err != nil {
+		return err
+	}
+
+	_, err := w.Write([]byte{RecordFormatVersion})
+	return err
+}
+
+// ReadFileHeader consumes file header if present. Returns false for legacy files which use PayloadSeparator.
+func ReadFileHeader(r *bufio.Reader) (bool, error) {
+	magic, err := r.Peek(len(FileMagic) + 1)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+
+	if len(magic) <= len(FileMagic) || !bytes.Equal(magic[:len(FileMagic)], FileMagic) {
+		return false, nil
+	}
+
+	if version := magic[len(FileMagic)]; version != RecordFormatVersion {
+		return false, fmt.Errorf("unsupported file format version %d", version)
+	}
+
+	_, err = r.Discard(len(magic))
+	return true, err
+}
+
+// WriteRecord writes length prefixed payload
+func WriteRecord(w io.Writer, payload []byte) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(payload)))
+
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+
+	_, err := w.Write(payload)
+	return err
+}
+
+// ReadRecord reads payload written by WriteRecord, returns io.EOF at the end of file
+func ReadRecord(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(size[:])
+	if length > maxRecordSize {
+		return nil, ErrRecordTooLarge
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,98 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	payloads := [][]byte{
+		[]byte("1 f45590522cd1838b4a0d5c5aab80b77929dea3b3 1231 53\nbody"),
+		// Binary payload may contain separator of legacy format
+		[]byte("1 f45590522cd1838b4a0d5c5aab80b77929dea3b3 1232 53\n\x00\xff" + PayloadSeparator),
+		{},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteFileHeader(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range payloads {
+		if err := WriteRecord(&buf, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := bufio.NewReader(&buf)
+	if records, err := ReadFileHeader(r); !records || err != nil {
+		t.Fatalf("header is not detected: %v", err)
+	}
+
+	for _, expected := range payloads {
+		payload, err := ReadRecord(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(payload, expected) {
+			t.Errorf("read %q, expected %q", payload, expected)
+		}
+	}
+
+	if _, err := ReadRecord(r); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestReadRecordBroken(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{"truncated length", "\x00\x00", io.ErrUnexpectedEOF},
+		{"truncated payload", "\x00\x00\x00\x05abc", io.ErrUnexpectedEOF},
+		{"length at the end", "\x00\x00\x00\x05", io.ErrUnexpectedEOF},
+		{"too large", "\xff\xff\xff\xffabc", ErrRecordTooLarge},
+	}
+
+	for _, tt := range tests {
+		if _, err := ReadRecord(bytes.NewReader([]byte(tt.data))); err != tt.err {
+			t.Errorf("%s: got %v, expected %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestReadFileHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		records bool
+		ok      bool
+	}{
+		{"legacy", "1 f45590522cd1838b4a0d5c5aab80b77929dea3b3 1231 53\nbody" + PayloadSeparator, false, true},
+		{"empty", "", false, true},
+		{"magic only", string(FileMagic), false, true},
+		{"current version", string(FileMagic) + "\x01", true, true},
+		{"unknown version", string(FileMagic) + "\x02", false, false},
+	}
+
+	for _, tt := range tests {
+		r := bufio.NewReader(bytes.NewReader([]byte(tt.data)))
+
+		records, err := ReadFileHeader(r)
+		if records != tt.records || (err == nil) != tt.ok {
+			t.Errorf("%s: records %v, error %v", tt.name, records, err)
+			continue
+		}
+
+		// Legacy file is read from the beginning
+		if !records && tt.ok {
+			if rest, _ := ioutil.ReadAll(r); string(rest) != tt.data {
+				t.Errorf("%s: header consumed, left %q", tt.name, rest)
+			}
+		}
+	}
+}
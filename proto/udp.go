@@ -7,6 +7,7 @@ import (
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"log"
+	"net"
 	"strconv"
 	"time"
 )
@@ -16,9 +17,26 @@ type UDPMessage struct {
 	Start      time.Time
 	SrcPort    uint16
 	DstPort    uint16
-	length     uint16
-	checksum   uint16
-	data       []byte
+	// ListenPort is the captured port from --input-udp the message belongs to,
+	// destination port for requests and source port for responses
+	ListenPort uint16
+	SrcIP      net.IP
+	DstIP      net.IP
+	// Capture interface, empty if unknown
+	Interface string
+	// IPv4 TTL and TOS, or IPv6 hop limit and traffic class
+	TTL uint8
+	TOS uint8
+	// VLAN tags and tunnels the packet was found in, outermost first, e.g. `vlan:10,vxlan:42`
+	Encapsulation string
+	// Latency is time between request and paired response, zero for requests and unmatched responses
+	Latency  time.Duration
+	uuid     []byte
+	length   uint16
+	checksum uint16
+	data     []byte
+	// Pooled buffer data and addresses point to, see Release
+	buffer *[]byte
 }
 
 func NewUDPMessage(data []byte, isIncoming bool) (m *UDPMessage) {
@@ -39,6 +57,10 @@ func NewUDPMessage(data []byte, isIncoming bool) (m *UDPMessage) {
 }
 
 func (m *UDPMessage) UUID() []byte {
+	if m.uuid != nil {
+		return m.uuid
+	}
+
 	var key []byte
 
 	key = strconv.AppendInt(key, m.Start.UnixNano(), 10)
@@ -49,14 +71,51 @@ func (m *UDPMessage) UUID() []byte {
 	uuid := make([]byte, 40)
 	sha := sha1.Sum(key)
 	hex.Encode(uuid, sha[:20])
+	m.uuid = uuid
 
 	return uuid
 }
 
+// PairWith makes response share ID of its request, and records server latency
+func (m *UDPMessage) PairWith(requestID []byte, requestStart time.Time) {
+	m.uuid = requestID
+	m.Latency = m.Start.Sub(requestStart)
+}
+
+// ClientAddr returns address of the peer which sent the request
+func (m *UDPMessage) ClientAddr() *net.UDPAddr {
+	if m.IsIncoming {
+		return &net.UDPAddr{IP: m.SrcIP, Port: int(m.SrcPort)}
+	}
+	return &net.UDPAddr{IP: m.DstIP, Port: int(m.DstPort)}
+}
+
+// ServerAddr returns address of the peer which received the request
+func (m *UDPMessage) ServerAddr() *net.UDPAddr {
+	if m.IsIncoming {
+		return &net.UDPAddr{IP: m.DstIP, Port: int(m.DstPort)}
+	}
+	return &net.UDPAddr{IP: m.SrcIP, Port: int(m.SrcPort)}
+}
+
 func (m *UDPMessage) Data() []byte {
 	return m.data
 }
 
+// SetBuffer passes ownership of pooled buffer which message data and addresses point to
+func (m *UDPMessage) SetBuffer(buf *[]byte) {
+	m.buffer = buf
+}
+
+// Release returns message buffer to the pool, message data and addresses must not be used after that
+func (m *UDPMessage) Release() {
+	PutBuffer(m.buffer)
+	m.buffer = nil
+	m.data = nil
+	m.SrcIP = nil
+	m.DstIP = nil
+}
+
 func (m *UDPMessage) String() string {
 	return fmt.Sprintf("SrcPort: %d | DstPort: %d | Length: %d | Checksum: %d | Data: %s",
 		m.SrcPort, m.DstPort, m.length, m.checksum, string(m.data))
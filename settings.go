@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/myzhan/goreplay-udp/listener"
 	"github.com/myzhan/goreplay-udp/output"
 	"time"
 )
@@ -22,21 +23,35 @@ func (h *MultiOption) Set(value string) error {
 
 // AppSettings is the struct of main configuration
 type AppSettings struct {
-	exitAfter time.Duration
+	exitAfter    time.Duration
+	drainTimeout time.Duration
 
-	splitOutput  bool
-	outputStdout bool
-	outputNull   bool
+	outputQueueSize   int
+	outputQueuePolicy string
+
+	splitOutput         bool
+	splitOutputStrategy string
+	splitOutputWeights  string
+	outputStdout        bool
+	outputNull          bool
 
 	inputFile        MultiOption
 	inputFileLoop    bool
+	inputPcap        MultiOption
+	inputPcapAddress string
 	outputFile       MultiOption
 	outputFileConfig output.FileOutputConfig
 
-	inputUDP              MultiOption
-	inputUDPTrackResponse bool
-	outputUDP             MultiOption
-	outputUDPConfig       output.UDPOutputConfig
+	outputDiff       MultiOption
+	outputDiffConfig output.DiffOutputConfig
+
+	inputUDP        MultiOption
+	inputUDPConfig  listener.CaptureConfig
+	outputUDP       MultiOption
+	outputUDPConfig output.UDPOutputConfig
+
+	outputRawUDP       MultiOption
+	outputRawUDPConfig output.RawUDPOutputConfig
 }
 
 // Settings holds Goreplay configuration
@@ -44,30 +59,73 @@ var Settings AppSettings
 
 func init() {
 	flag.DurationVar(&Settings.exitAfter, "exit-after", 0, "exit after specified duration")
+	flag.DurationVar(&Settings.drainTimeout, "drain-timeout", 10*time.Second, "On exit, max time to send data already read by inputs and queued in outputs. Default: 10s")
+	flag.IntVar(&Settings.outputQueueSize, "output-queue-size", 1000, "Every output has its own queue, so slow output doesn't hold up inputs and other outputs. Max number of payloads in each queue. Default: 1000")
+	flag.StringVar(&Settings.outputQueuePolicy, "output-queue-policy", "block", "What to do when queue of an output is full: 'block' waits and slows down inputs, 'drop-newest' drops incoming payload, 'drop-oldest' drops the oldest queued one. Drops are reported every 5 seconds")
 
-	flag.BoolVar(&Settings.splitOutput, "split-output", false, "By default each output gets same traffic. If set to `true` it splits traffic equally among all outputs")
+	flag.BoolVar(&Settings.splitOutput, "split-output", false, "By default each output gets same traffic. If set to `true` it splits requests equally among all outputs, responses still go to all of them")
+	flag.StringVar(&Settings.splitOutputStrategy, "split-output-strategy", splitRoundRobin, "How --split-output picks output for each payload: round-robin, weighted (see --split-output-weights) or flow-hash, which keeps each client ip:port on the same output. Default: round-robin")
+	flag.StringVar(&Settings.splitOutputWeights, "split-output-weights", "", "Comma separated weights for weighted --split-output, one per output in order: stdout, null, file, diff, udp and raw udp outputs, each type in command line order. Example: --split-output-weights 3,1")
 	flag.BoolVar(&Settings.outputStdout, "output-stdout", false, "Used for testing inputs. Just prints to console data coming from inputs")
 	flag.BoolVar(&Settings.outputNull, "output-null", false, "Used for testing inputs. Drops all requests")
 
 	flag.Var(&Settings.inputFile, "input-file", "Read requests from file: \n\tgoreplay-udp --input-file ./requests.gor --output-stdout")
 	flag.BoolVar(&Settings.inputFileLoop, "input-file-loop", false, "Loop input files, useful for performance testing")
 
+	flag.Var(&Settings.inputPcap, "input-pcap", "Read UDP traffic from .pcap or .pcapng file, e.g. captured by tcpdump: \n\tgoreplay-udp --input-pcap ./dns.pcap --input-pcap-address :53 --output-stdout")
+	flag.StringVar(&Settings.inputPcapAddress, "input-pcap-address", ":*", "Address to filter pcap files by, same as for --input-udp. Use --input-udp-track-response to include responses. Example: --input-pcap-address :53. Default: :*, any host and port")
+
 	flag.Var(&Settings.outputFile, "output-file", "Write incoming requests to file: \n\tgoreplay-udp --input-udp :80 --output-file ./requests.gor")
 	flag.DurationVar(&Settings.outputFileConfig.FlushInterval, "output-file-flush-interval", time.Second, "Interval for forcing buffer flush to the file, default: 1s")
 	flag.BoolVar(&Settings.outputFileConfig.Append, "output-file-append", false, "The flushed chunk is appended to existence file or not")
+	flag.StringVar(&Settings.outputFileConfig.Format, "output-file-format", output.FileFormatRecords, "Format of written files: records is binary safe, legacy separates payloads with a line. --input-file reads both. Default: records")
 
 	// Set default
 	Settings.outputFileConfig.SizeLimit.Set("32mb")
 	flag.Var(&Settings.outputFileConfig.SizeLimit, "output-file-size-limit", "Size of each chunk. Default: 32mb")
 	flag.IntVar(&Settings.outputFileConfig.QueueLimit, "output-file-queue-limit", 25600, "The length of the chunk queue. Default: 25600")
 
-	flag.Var(&Settings.inputUDP, "input-udp", "Capture traffic from given port (use RAW sockets and require *sudo* access):\n\t# Capture traffic from 8080 port\n\tgoreplay-udp --input-raw :8080 --output-stdout")
-	flag.BoolVar(&Settings.inputUDPTrackResponse, "input-udp-track-response", false, "If turned on gorepaly-udp will track responses in addition to requests")
-
-	flag.Var(&Settings.outputUDP, "output-udp", "Forwards incoming requests to given udp address.\n\t# Redirect all incoming requests to staging.com address \n\tgoreplay-udp --input-raw :80 --output-udp staging.com")
+	flag.Var(&Settings.outputDiff, "output-diff", "Compare original responses with replayed ones by request ID and write differences to file:\n\tgoreplay-udp --input-file requests.gor --output-udp staging:53 --output-udp-track-response --output-diff diff.log")
+	flag.StringVar(&Settings.outputDiffConfig.Ignore, "output-diff-ignore", "", "Comma separated byte ranges excluded from comparison, like transaction IDs or timestamps. Example: --output-diff-ignore 0-1,20-")
+	flag.StringVar(&Settings.outputDiffConfig.Decoder, "output-diff-decoder", output.DiffDecoderBytes, "Compare raw bytes, or decoded messages without volatile fields: bytes or dns. Default: bytes")
+	flag.DurationVar(&Settings.outputDiffConfig.Timeout, "output-diff-timeout", 30*time.Second, "Report response as unpaired if its pair doesn't come in given time. Default: 30s")
+
+	flag.Var(&Settings.inputUDP, "input-udp", "Capture traffic from given port (use RAW sockets and require *sudo* access):\n\t# Capture traffic from 8080 port\n\tgoreplay-udp --input-raw :8080 --output-stdout\n\t# Capture traffic from several ports, port ranges or any port\n\tgoreplay-udp --input-udp :53,5060-5070 --output-stdout\n\tgoreplay-udp --input-udp :* --output-stdout\n\t# Capture IPv6 traffic, link-local address needs interface name\n\tgoreplay-udp --input-udp [fe80::1%eth0]:53 --output-stdout\n\t# Capture multicast group on all interfaces, or on one given as zone\n\tgoreplay-udp --input-udp 239.1.1.1%eth0:5000 --output-stdout\n\t# Capture other host on interface receiving its mirrored traffic, e.g. switch SPAN port\n\tgoreplay-udp --input-udp 10.1.2.3%eth1:53 --output-stdout\n\t# Capture on interface by name, including Linux `any` device and tun interfaces\n\tgoreplay-udp --input-udp any:53 --output-stdout\n\t# Capture packets logged by iptables NFLOG rule with --nflog-group 5\n\tgoreplay-udp --input-udp [nflog:5]:53 --output-stdout")
+	flag.BoolVar(&Settings.inputUDPConfig.TrackResponse, "input-udp-track-response", false, "If turned on gorepaly-udp will track responses in addition to requests")
+	flag.DurationVar(&Settings.inputUDPConfig.ResponseTimeout, "input-udp-response-timeout", 5*time.Second, "Max time between request and response to pair them, paired response gets request ID and latency. Default: 5s")
+	flag.DurationVar(&Settings.inputUDPConfig.DefragTimeout, "input-udp-defrag-timeout", 30*time.Second, "Drop fragmented IP datagrams not reassembled in given time. Default: 30s")
+	flag.IntVar(&Settings.inputUDPConfig.DefragMemoryLimit, "input-udp-defrag-memory-limit", 4, "Memory limit for incomplete fragmented IP datagrams, in megabytes. Default: 4")
+	flag.StringVar(&Settings.inputUDPConfig.Engine, "input-udp-engine", "pcap", "Capture engine: 'pcap', or 'af_packet' which reads memory mapped rings of several sockets per Ethernet or raw IP interface, like tun (Linux only):\n\tgoreplay-udp --input-udp :53 --input-udp-engine af_packet --input-udp-fanout 4 --output-stdout")
+	flag.IntVar(&Settings.inputUDPConfig.Fanout, "input-udp-fanout", 0, "Number of af_packet sockets sharing load of each interface, each with own goroutine. By default number of CPUs")
+	flag.IntVar(&Settings.inputUDPConfig.DecapDepth, "input-udp-decap-depth", 0, "Look for UDP inside up to given number of VLAN tags and GRE, VXLAN (port 4789) or GENEVE (port 6081) tunnels. Packets nested deeper are skipped. Tunneled packets are matched by port only, their path is recorded in 'encap' header field. Default: 0, disabled")
+	flag.StringVar(&Settings.inputUDPConfig.VLAN, "input-udp-vlan", "", "Comma separated VLAN IDs to capture with --input-udp-decap-depth, others are skipped")
+	flag.StringVar(&Settings.inputUDPConfig.VNI, "input-udp-vni", "", "Comma separated VXLAN or GENEVE network identifiers to capture with --input-udp-decap-depth, others are skipped")
+	flag.IntVar(&Settings.inputUDPConfig.PacketQueueSize, "input-udp-packet-queue-size", 10000, "Max number of captured IP packets waiting to be parsed. Default: 10000")
+	flag.StringVar(&Settings.inputUDPConfig.PacketQueuePolicy, "input-udp-packet-queue-policy", "block", "What to do when captured packets queue is full: 'block' (kernel drops packets then), 'drop-newest' or 'drop-oldest'. Drops are reported every 5 seconds")
+	flag.IntVar(&Settings.inputUDPConfig.MessageQueueSize, "input-udp-message-queue-size", 10000, "Max number of parsed UDP messages waiting for outputs. Default: 10000")
+	flag.StringVar(&Settings.inputUDPConfig.MessageQueuePolicy, "input-udp-message-queue-policy", "block", "What to do when UDP messages queue is full: 'block', 'drop-newest' or 'drop-oldest'. Drops are reported every 5 seconds")
+
+	flag.Var(&Settings.outputUDP, "output-udp", "Forwards incoming requests to given udp address.\n\t# Redirect all incoming requests to staging.com address \n\tgoreplay-udp --input-raw :80 --output-udp staging.com\n\t# IPv6 target\n\tgoreplay-udp --input-udp :53 --output-udp [2001:db8::53]:53\n\t# Send each request to the port it was captured on\n\tgoreplay-udp --input-udp :5060-5070 --output-udp staging.com:*\n\t# Multicast group or broadcast target, the first answer of any member is taken as response\n\tgoreplay-udp --input-udp 239.1.1.1:5000 --output-udp 239.2.2.2:5000")
 	flag.IntVar(&Settings.outputUDPConfig.Workers, "output-udp-workers", 0, "Goreplay-udp uses dynamic worker scaling by default.  Enter a number to run a set number of workers.")
 	flag.DurationVar(&Settings.outputUDPConfig.Timeout, "output-udp-timeout", 5*time.Second, "Specify UDP request/response timeout. By default 5s. Example: --output-udp-timeout 30s")
-	flag.BoolVar(&Settings.outputUDPConfig.Stats, "output-udp-stats", false, "Report udp output queue stats to console every 5 seconds")
+	flag.BoolVar(&Settings.outputUDPConfig.Stats, "output-udp-stats", false, "Report udp output queue stats and latency percentiles of replayed requests to console every 5 seconds, and latency summary on exit")
 	flag.BoolVar(&Settings.outputUDPConfig.IgnoreResponse, "output-udp-ignore-response", false, "Ignore UDP Response")
-
+	flag.BoolVar(&Settings.outputUDPConfig.SessionAffinity, "output-udp-session-affinity", false, "Replay each captured client ip:port from its own source socket, keeping order of its packets. Useful for servers which keep per-peer state")
+	flag.DurationVar(&Settings.outputUDPConfig.SessionTimeout, "output-udp-session-timeout", time.Minute, "Close client session socket after given time of inactivity. Default: 1m")
+	flag.IntVar(&Settings.outputUDPConfig.MaxSessions, "output-udp-max-sessions", 1024, "Max number of client sessions, least recently used one is closed to open a new one. Default: 1024")
+	flag.BoolVar(&Settings.outputUDPConfig.Timing, "output-udp-timing", false, "Keep captured intervals between requests instead of sending them as soon as possible, so bursts look like in production. Lag is reported with --output-udp-stats")
+	flag.DurationVar(&Settings.outputUDPConfig.MaxDelay, "output-udp-timing-max-delay", time.Second, "Max time --output-udp-timing waits for, or lags behind, a request before resetting the schedule. Default: 1s")
+	flag.IntVar(&Settings.outputUDPConfig.BatchSize, "output-udp-batch", 0, "Send up to given number of queued requests with one syscall (sendmmsg on Linux), for load tests with high packet rates. Requires --output-udp-ignore-response, uses --output-udp-workers workers or 1:\n\tgoreplay-udp --input-file requests.gor --output-udp staging:53 --output-udp-ignore-response --output-udp-batch 64")
+	flag.DurationVar(&Settings.outputUDPConfig.ResolveInterval, "output-udp-resolve-interval", 30*time.Second, "Resolve target hostname again after given interval, requests are spread over all its A/AAAA records. 0 resolves it once. Default: 30s")
+	flag.IntVar(&Settings.outputUDPConfig.MulticastTTL, "output-udp-multicast-ttl", 0, "TTL of requests sent to multicast group, by default system one is used, which keeps them on local network:\n\tgoreplay-udp --input-file requests.gor --output-udp 239.1.1.1:5000 --output-udp-multicast-ttl 8")
+	flag.BoolVar(&Settings.outputUDPConfig.MulticastLoopback, "output-udp-multicast-loopback", true, "Deliver requests sent to multicast group to listeners on this host too. Default: true")
+	flag.StringVar(&Settings.outputUDPConfig.MulticastInterface, "output-udp-multicast-interface", "", "Interface name to send multicast requests from, e.g. eth1. By default zone of the group address or system route is used")
+	flag.BoolVar(&Settings.outputUDPConfig.TrackResponses, "output-udp-track-response", false, "If turned on, replayed responses are passed to other outputs with the original request ID and latency:\n\tgoreplay-udp --input-file requests.gor --output-udp staging:53 --output-udp-track-response --output-file replayed.gor")
+	flag.IntVar(&Settings.outputUDPConfig.QueueSize, "output-udp-queue-size", 10000, "Max number of requests waiting to be sent, per client session with --output-udp-session-affinity. Default: 10000")
+	flag.StringVar(&Settings.outputUDPConfig.QueuePolicy, "output-udp-queue-policy", "block", "What to do when output queue is full: 'block' waits and slows down inputs, 'drop-newest' drops incoming request, 'drop-oldest' drops the oldest queued one. Drops are reported every 5 seconds")
+	flag.StringVar(&Settings.outputUDPConfig.SpillDir, "output-udp-spill-dir", "", "Queue requests in given directory instead of memory, so a slow or down target doesn't block or drop them. Backlog is kept between restarts and reported every 5 seconds:\n\tgoreplay-udp --input-udp :53 --output-udp staging:53 --output-udp-spill-dir /var/spool/gor")
+	flag.IntVar(&Settings.outputUDPConfig.SpillMaxSize, "output-udp-spill-max-size", 1024, "Max disk space of --output-udp-spill-dir queue of each output, in megabytes. New requests are dropped when it is full. Default: 1024")
+
+	flag.Var(&Settings.outputRawUDP, "output-udp-raw", "Forwards incoming requests to given udp address from their original client ip:port, using raw sockets (Linux only, requires *sudo* access). Replies go to the original clients, use in isolated networks:\n\tgoreplay-udp --input-file requests.gor --output-udp-raw 10.0.0.53:53")
+	flag.Var((*MultiOption)(&Settings.outputRawUDPConfig.Rewrite), "output-udp-raw-rewrite", "Rewrite source subnet for --output-udp-raw, keeping host part of the address. Can be given multiple times:\n\tgoreplay-udp --input-file requests.gor --output-udp-raw 10.0.0.53:53 --output-udp-raw-rewrite 172.16.0.0/16=10.1.0.0/16")
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"github.com/myzhan/goreplay-udp/proto"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Strategies of --split-output
+const (
+	splitRoundRobin = "round-robin"
+	splitWeighted   = "weighted"
+	splitFlowHash   = "flow-hash"
+)
+
+// outputSplitter picks a single output for each request, instead of writing it to all of them
+type outputSplitter struct {
+	writers  []io.Writer
+	strategy string
+
+	index int
+
+	// Smooth weighted round robin state, see nginx upstream balancing
+	weights []int
+	current []int
+	total   int
+}
+
+func newOutputSplitter(strategy string, weights string, writers []io.Writer) (*outputSplitter, error) {
+	s := &outputSplitter{writers: writers, strategy: strategy}
+
+	switch strategy {
+	case splitRoundRobin, splitFlowHash:
+	case splitWeighted:
+		for _, w := range strings.Split(weights, ",") {
+			weight, err := strconv.Atoi(strings.TrimSpace(w))
+			if err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid output weight %q", w)
+			}
+			s.weights = append(s.weights, weight)
+			s.total += weight
+		}
+
+		if len(s.weights) != len(writers) {
+			return nil, fmt.Errorf("got %d output weights for %d outputs", len(s.weights), len(writers))
+		}
+		if s.total == 0 {
+			return nil, fmt.Errorf("at least one output weight should be positive")
+		}
+
+		s.current = make([]int, len(writers))
+	default:
+		return nil, fmt.Errorf("unknown split strategy %q", strategy)
+	}
+
+	return s, nil
+}
+
+func (s *outputSplitter) pick(payload []byte) io.Writer {
+	switch s.strategy {
+	case splitWeighted:
+		best := 0
+		for i, w := range s.weights {
+			s.current[i] += w
+			if s.current[i] > s.current[best] {
+				best = i
+			}
+		}
+		s.current[best] -= s.total
+
+		return s.writers[best]
+	case splitFlowHash:
+		// Requests of one client ip:port go to the same output.
+		// Payloads recorded without client address fall back to round robin.
+		if client := proto.PayloadMetaValue(payload, proto.MetaClient); client != nil {
+			h := fnv.New32a()
+			h.Write(client)
+			return s.writers[h.Sum32()%uint32(len(s.writers))]
+		}
+	}
+
+	s.index = (s.index + 1) % len(s.writers)
+	return s.writers[s.index]
+}
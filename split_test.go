@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/myzhan/goreplay-udp/proto"
+)
+
+type namedWriter string
+
+func (w namedWriter) Write(data []byte) (int, error) { return len(data), nil }
+
+func testWriters(names ...string) (writers []io.Writer) {
+	for _, name := range names {
+		writers = append(writers, namedWriter(name))
+	}
+	return
+}
+
+func splitRequest(client string) []byte {
+	return append(proto.PayloadExtendedHeader(proto.RequestPayload, []byte("f45590522cd1838b4a0d5c5aab80b77929dea3b3"), 1, 53, proto.MetaClient, client), "body"...)
+}
+
+// picks returns names of outputs picked for n requests of the same client
+func picks(s *outputSplitter, client string, n int) string {
+	var names []string
+	for i := 0; i < n; i++ {
+		names = append(names, string(s.pick(splitRequest(client)).(namedWriter)))
+	}
+	return strings.Join(names, " ")
+}
+
+func TestOutputSplitter(t *testing.T) {
+	tests := []struct {
+		strategy string
+		weights  string
+		writers  []io.Writer
+		picked   string
+	}{
+		{splitRoundRobin, "", testWriters("a", "b", "c"), "b c a b c a"},
+		{splitRoundRobin, "", testWriters("a"), "a a a"},
+		// Smooth weighted round robin spreads picks of heavy output
+		{splitWeighted, "5,1,1", testWriters("a", "b", "c"), "a a b a c a a a a b a c a a"},
+		{splitWeighted, "1, 2", testWriters("a", "b"), "b a b b a b"},
+		{splitWeighted, "1,0", testWriters("a", "b"), "a a a"},
+		// Requests without client address fall back to round robin
+		{splitFlowHash, "", testWriters("a", "b", "c"), "b c a b"},
+	}
+
+	for _, tt := range tests {
+		s, err := newOutputSplitter(tt.strategy, tt.weights, tt.writers)
+		if err != nil {
+			t.Errorf("%s %q: %v", tt.strategy, tt.weights, err)
+			continue
+		}
+
+		if picked := picks(s, "", len(strings.Fields(tt.picked))); picked != tt.picked {
+			t.Errorf("%s %q: picked %q, expected %q", tt.strategy, tt.weights, picked, tt.picked)
+		}
+	}
+}
+
+func TestOutputSplitterFlowHash(t *testing.T) {
+	s, err := newOutputSplitter(splitFlowHash, "", testWriters("a", "b", "c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	used := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		client := fmt.Sprintf("10.0.0.%d:5353", i)
+
+		// The same output for every request of a client
+		picked := picks(s, client, 3)
+		names := strings.Fields(picked)
+		if names[0] != names[1] || names[1] != names[2] {
+			t.Fatalf("%s: picked %q", client, picked)
+		}
+		used[names[0]] = true
+	}
+
+	if len(used) != 3 {
+		t.Errorf("clients are hashed to %d outputs of 3", len(used))
+	}
+}
+
+func TestOutputSplitterErrors(t *testing.T) {
+	tests := []struct {
+		strategy string
+		weights  string
+	}{
+		{"random", ""},
+		{splitWeighted, "1,2"},
+		{splitWeighted, "1,2,3,4"},
+		{splitWeighted, "1,-1,1"},
+		{splitWeighted, "1,x,1"},
+		{splitWeighted, "0,0,0"},
+		{splitWeighted, ""},
+	}
+
+	for _, tt := range tests {
+		if _, err := newOutputSplitter(tt.strategy, tt.weights, testWriters("a", "b", "c")); err == nil {
+			t.Errorf("%s %q: expected error", tt.strategy, tt.weights)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package stats
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Counter counts events, reported every 5 seconds when there are new ones
+type Counter struct {
+	// Keep first for 64bit alignment of atomic operations
+	count int64
+
+	statName string
+	event    string
+	reported int64
+}
+
+func NewCounter(statName string, event string) (c *Counter) {
+	c = new(Counter)
+	c.statName = statName
+	c.event = event
+
+	go c.reportStats()
+
+	return
+}
+
+func (c *Counter) Add(n int) {
+	atomic.AddInt64(&c.count, int64(n))
+}
+
+func (c *Counter) Count() int64 {
+	return atomic.LoadInt64(&c.count)
+}
+
+func (c *Counter) reportStats() {
+	for {
+		time.Sleep(internal * time.Second)
+
+		count := c.Count()
+		if count != c.reported {
+			log.Printf("%s:%s %d, last %ds %d\n", c.statName, c.event, count, internal, count-c.reported)
+			c.reported = count
+		}
+	}
+}
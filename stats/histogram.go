@@ -0,0 +1,166 @@
+package stats
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Values below 2^subBucketBits microseconds are exact, larger ones have less than 1/2^(subBucketBits-1), 0.8% error
+const (
+	subBucketBits  = 8
+	subBucketCount = 1 << subBucketBits
+	subBucketHalf  = subBucketCount / 2
+	bucketsCount   = subBucketCount + (64-subBucketBits)*subBucketHalf
+)
+
+// histogram counts microseconds in log-linear buckets, like HDR histogram
+type histogram struct {
+	counts   [bucketsCount]int64
+	count    int64
+	max      int64
+	timeouts int64
+	errors   int64
+}
+
+func bucketIndex(v int64) int {
+	if v < subBucketCount {
+		return int(v)
+	}
+
+	shift := bits.Len64(uint64(v)) - subBucketBits
+	return subBucketCount + (shift-1)*subBucketHalf + int(v>>uint(shift)) - subBucketHalf
+}
+
+// bucketValue returns the highest value of the bucket
+func bucketValue(index int) int64 {
+	if index < subBucketCount {
+		return int64(index)
+	}
+
+	shift := uint((index-subBucketCount)/subBucketHalf + 1)
+	sub := int64((index-subBucketCount)%subBucketHalf + subBucketHalf)
+	return (sub+1)<<shift - 1
+}
+
+func (h *histogram) record(us int64) {
+	if us < 0 {
+		us = 0
+	}
+
+	h.counts[bucketIndex(us)]++
+	h.count++
+	if us > h.max {
+		h.max = us
+	}
+}
+
+func (h *histogram) percentile(q float64) int64 {
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := int64(q*float64(h.count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen int64
+	for i, c := range h.counts {
+		if seen += c; seen >= rank {
+			if v := bucketValue(i); v < h.max {
+				return v
+			}
+			return h.max
+		}
+	}
+
+	return h.max
+}
+
+func (h *histogram) String() string {
+	ms := func(us int64) string {
+		return fmt.Sprintf("%.3fms", float64(us)/1000)
+	}
+
+	return fmt.Sprintf("count %d, p50 %s, p90 %s, p99 %s, p999 %s, max %s, timeouts %d, errors %d",
+		h.count, ms(h.percentile(0.5)), ms(h.percentile(0.9)), ms(h.percentile(0.99)), ms(h.percentile(0.999)),
+		ms(h.max), h.timeouts, h.errors)
+}
+
+// LatencyStat reports request latency percentiles every 5 seconds, and for the whole run on Close
+type LatencyStat struct {
+	mu       sync.Mutex
+	statName string
+	interval histogram
+	total    histogram
+	closed   bool
+}
+
+func NewLatencyStat(statName string) (s *LatencyStat) {
+	s = new(LatencyStat)
+	s.statName = statName
+
+	go s.reportStats()
+
+	return
+}
+
+// Write records latency of successful request, or counts timeout or error
+func (s *LatencyStat) Write(latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case err == nil:
+		us := latency.Nanoseconds() / 1000
+		s.interval.record(us)
+		s.total.record(us)
+	case isTimeout(err):
+		s.interval.timeouts++
+		s.total.timeouts++
+	default:
+		s.interval.errors++
+		s.total.errors++
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout() || errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func (s *LatencyStat) reportStats() {
+	for {
+		time.Sleep(internal * time.Second)
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+
+		log.Println(s.statName + ":" + s.interval.String())
+		s.interval = histogram{}
+		s.mu.Unlock()
+	}
+}
+
+// Close prints summary of the whole run
+func (s *LatencyStat) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	log.Println(s.statName + " summary:" + s.total.String())
+	return nil
+}
@@ -0,0 +1,121 @@
+package stats
+
+import (
+	"errors"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBucketIndex(t *testing.T) {
+	tests := []struct {
+		value int64
+		index int
+		// Highest value of the bucket
+		high int64
+	}{
+		{0, 0, 0},
+		{255, 255, 255},
+		// Buckets of 2 values
+		{256, 256, 257},
+		{257, 256, 257},
+		{511, 383, 511},
+		// Buckets of 4 values
+		{512, 384, 515},
+		{1023, 511, 1023},
+		{1024, 512, 1031},
+		{math.MaxInt64, bucketsCount - 129, math.MaxInt64},
+	}
+
+	for _, tt := range tests {
+		index := bucketIndex(tt.value)
+		if index != tt.index || bucketValue(index) != tt.high {
+			t.Errorf("%d: bucket %d up to %d, expected %d up to %d", tt.value, index, bucketValue(index), tt.index, tt.high)
+		}
+	}
+}
+
+func TestBucketBoundaries(t *testing.T) {
+	check := func(v int64) {
+		index := bucketIndex(v)
+		if index < 0 || index >= bucketsCount {
+			t.Fatalf("%d: bucket %d out of range", v, index)
+		}
+
+		// Value is within its bucket, and the bucket starts after the previous one
+		if high := bucketValue(index); high < v || (index > 0 && bucketValue(index-1) >= v) {
+			t.Fatalf("%d: bucket %d ends at %d, previous one at %d", v, index, high, bucketValue(index-1))
+		}
+
+		if high := bucketValue(index); v >= subBucketCount && float64(high-v)/float64(v) > 1.0/subBucketHalf {
+			t.Fatalf("%d: error of bucket %d ending at %d is above 1/%d", v, index, high, subBucketHalf)
+		}
+	}
+
+	for v := int64(0); v < 1<<16; v++ {
+		check(v)
+	}
+	for shift := uint(16); shift < 63; shift++ {
+		for _, d := range []int64{-1, 0, 1} {
+			check(1<<shift + d)
+		}
+	}
+	check(math.MaxInt64)
+}
+
+func TestHistogramPercentile(t *testing.T) {
+	var h histogram
+	if p := h.percentile(0.5); p != 0 {
+		t.Errorf("empty histogram: p50 %d", p)
+	}
+
+	for us := int64(1); us <= 1000; us++ {
+		h.record(us)
+	}
+
+	tests := []struct {
+		q     float64
+		value int64
+	}{
+		// Exact below 256
+		{0, 1},
+		{0.1, 100},
+		// Highest value of the bucket
+		{0.5, 501},
+		{0.9, 903},
+		{0.99, 991},
+		{0.999, 999},
+		// Never above max, bucket of 1000 ends at 1003
+		{1, 1000},
+	}
+
+	for _, tt := range tests {
+		if p := h.percentile(tt.q); p != tt.value {
+			t.Errorf("p%v: got %d, expected %d", tt.q*100, p, tt.value)
+		}
+	}
+
+	// Bucket of 300 ends at 301
+	var single histogram
+	single.record(300)
+	single.record(-5)
+	if p := single.percentile(1); p != 300 {
+		t.Errorf("single value: p100 %d", p)
+	}
+	if p := single.percentile(0.5); p != 0 {
+		t.Errorf("negative value isn't recorded as 0: p50 %d", p)
+	}
+}
+
+func TestLatencyStatWrite(t *testing.T) {
+	s := &LatencyStat{}
+
+	s.Write(2*time.Millisecond, nil)
+	s.Write(0, os.ErrDeadlineExceeded)
+	s.Write(0, errors.New("connection refused"))
+
+	if s.total.count != 1 || s.total.max != 2000 || s.total.timeouts != 1 || s.total.errors != 1 {
+		t.Errorf("count %d, max %d, timeouts %d, errors %d", s.total.count, s.total.max, s.total.timeouts, s.total.errors)
+	}
+}
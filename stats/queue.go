@@ -0,0 +1,32 @@
+package stats
+
+import "fmt"
+
+// Policies of full queues
+const (
+	// Producer waits for free space, so slow consumer slows down everything before it
+	QueueBlock = "block"
+	// Item which doesn't fit is dropped
+	QueueDropNewest = "drop-newest"
+	// The oldest queued item is dropped to free space
+	QueueDropOldest = "drop-oldest"
+)
+
+// ValidateQueue checks queue size and policy given in flags
+func ValidateQueue(name string, size int, policy string) error {
+	if size <= 0 {
+		return fmt.Errorf("%s: queue size should be positive, got %d", name, size)
+	}
+
+	switch policy {
+	case QueueBlock, QueueDropNewest, QueueDropOldest:
+		return nil
+	}
+
+	return fmt.Errorf("%s: unknown queue policy %q, use %q, %q or %q", name, policy, QueueBlock, QueueDropNewest, QueueDropOldest)
+}
+
+// NewDropCounter counts items dropped from a full queue
+func NewDropCounter(statName string) *Counter {
+	return NewCounter(statName, "dropped")
+}